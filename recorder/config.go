@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/pumpingstationone/shopmon/shared/mqttclient"
+)
+
+// Config is everything that can be set in config.ini, the
+// environment or on the command line (see the shared/config package)
+type Config struct {
+	MQTT     mqttclient.Options
+	Topics   TopicConfig
+	Database DatabaseConfig
+	Sensors  SensorConfig
+}
+
+// TopicConfig is the MQTT topics we listen on
+type TopicConfig struct {
+	// The raw messages from the sensors program, every one of
+	// which is an activation
+	Sensors string `help:"topic the sensors publish on"`
+	// The messages from sensorstatus, which tell us when each
+	// sensor goes on and off. This can be the old
+	// "webshopmontopic" or the JSON "shopmon/status"
+	Status string `help:"topic to get sensor status from"`
+}
+
+// DatabaseConfig is where we keep the history
+type DatabaseConfig struct {
+	File string `help:"the SQLite database to record history in"`
+}
+
+// SensorConfig is where we find out about the sensors
+type SensorConfig struct {
+	File string `help:"the sensors.json file from the sensors program"`
+}
+
+// defaultConfig is what we use if nothing else is given
+func defaultConfig() Config {
+	return Config{
+		MQTT: mqttclient.Options{
+			Broker: "tcp://10.10.1.224:1883",
+			// The clientID must be a unique name for listening on the
+			// topics, otherwise you may get disconnect errors
+			ClientID: "recorder",
+		},
+		Topics: TopicConfig{
+			Sensors: "shopmontopic",
+			Status:  "webshopmontopic",
+		},
+		Database: DatabaseConfig{
+			File: "shopmon.db",
+		},
+		Sensors: SensorConfig{
+			File: "../sensors/sensors.json",
+		},
+	}
+}
+
+// Validate checks the parts of the config that are ours
+func (c *Config) Validate() error {
+	if len(c.Topics.Sensors) == 0 && len(c.Topics.Status) == 0 {
+		return errors.New("no topics to record given")
+	}
+	if c.Topics.Sensors == c.Topics.Status {
+		return errors.New("the sensors and status topics have to be different")
+	}
+	if len(c.Database.File) == 0 {
+		return errors.New("no database file given")
+	}
+	return nil
+}
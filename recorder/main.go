@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pumpingstationone/shopmon/shared/config"
+	"github.com/pumpingstationone/shopmon/shared/history"
+	"github.com/pumpingstationone/shopmon/shared/message"
+	"github.com/pumpingstationone/shopmon/shared/registry"
+)
+
+/*
+ * Everything else in shopmon only cares about right now (or the last time
+ * an area was used), so this program writes down everything that happens
+ * so that we can look back at it later. Every sensor activation from the
+ * sensors program, and every stretch of time sensorstatus says a sensor was
+ * on, goes into a SQLite database (see the history package in shared).
+ */
+
+// Received is a message from one of our topics
+type Received struct {
+	payload string
+	// Whether it came from sensorstatus (true) or straight from
+	// the sensors program (false)
+	fromStatus bool
+	// When we got it
+	at time.Time
+}
+
+// Our channel that accepts messages from the MQTT server
+var recordChannel = make(chan Received, 100)
+
+// Our settings (see config.go)
+var cfg = defaultConfig()
+
+// Every sensor we know about, from sensors.json
+var sensors *registry.Registry
+
+func main() {
+	// Read our settings first, as everything depends on them
+	if err := config.Load("recorder", &cfg, os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	// What sensors we have, so that everything is recorded in the
+	// right area even if the message has it wrong
+	sensors = registry.New(cfg.Sensors.File)
+	if err := sensors.Reload(); err != nil {
+		log.Println("Could not load sensors:", err)
+	}
+
+	// And where we're writing it all down
+	db, err := history.Open(cfg.Database.File)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	// Everything runs until we get told to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := listenOnTopics(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	// Pick up any changes to sensors.json as they happen
+	go sensors.Watch(ctx)
+
+	// And here we go!
+	for {
+		var received Received
+		select {
+		case received = <-recordChannel:
+		case <-ctx.Done():
+			fmt.Println("Goodbye")
+			return
+		}
+
+		event, err := message.Parse([]byte(received.payload))
+		if err != nil {
+			log.Printf("Ignoring message: %v\n", err)
+			continue
+		}
+		sensors.Enrich(&event)
+
+		if received.fromStatus {
+			err = db.RecordStatus(event, received.at)
+		} else {
+			err = db.RecordActivation(event)
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pumpingstationone/shopmon/shared/mqttclient"
+)
+
+// onMessageReceived returns the handler for one of our topics, which
+// hands each message to main() along with when we got it
+func onMessageReceived(fromStatus bool) mqttclient.Handler {
+	return func(topic string, payload []byte) {
+		log.Printf("Received message on topic: %s\nMessage: %s\n", topic, payload)
+		recordChannel <- Received{
+			payload:    string(payload),
+			fromStatus: fromStatus,
+			at:         time.Now(),
+		}
+	}
+}
+
+// listenOnTopics connects to the MQTT server and subscribes to the
+// sensor and status topics. The connection (and subscriptions) are
+// kept alive until the context is cancelled
+func listenOnTopics(ctx context.Context) error {
+	client, err := mqttclient.New(cfg.MQTT)
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.Topics.Sensors) > 0 {
+		if err := client.Subscribe(cfg.Topics.Sensors, onMessageReceived(false)); err != nil {
+			return err
+		}
+	}
+	if len(cfg.Topics.Status) > 0 {
+		if err := client.Subscribe(cfg.Topics.Status, onMessageReceived(true)); err != nil {
+			return err
+		}
+	}
+
+	return client.Connect(ctx)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+
+	"github.com/pumpingstationone/shopmon/shared/message"
+)
+
+/*
+ * Most areas have more than one sensor in them (e.g. Woodshop-1, -2 and -3
+ * are all in the Woodshop), and what people usually want to know is whether
+ * anyone is in the area, not which sensor saw them. An area is occupied for
+ * as long as any of its sensors are on, and we publish a message on
+ * <area topic>/<area name> (e.g. "shopmon/area/Woodshop") whenever an area
+ * goes from vacant to occupied or back, plus a reminder of every occupied
+ * area every Heartbeat. The state of each area and the last time anything
+ * in it was triggered are also kept up to date on retained topics (see
+ * retained.go).
+ */
+
+// AreaUpdate is an area message for the MQTT server and what kind
+// of update it is (see StatusUpdate in main.go). A steady update just
+// means that something in the area was triggered again, which only
+// matters for the area's last_seen topic
+type AreaUpdate struct {
+	event message.AreaEvent
+	kind  int
+}
+
+// The channel we are going to use to send the area messages to
+// the MQTT server
+var areaStatusChannel chan AreaUpdate
+
+// The areas we've told everyone are occupied, the last time anything
+// in each area was triggered, and the last of those times we've told
+// everyone about. All are guarded by the same mutex as sensorMap
+var liveAreas = make(map[string]bool)
+var areaLastSeen = make(map[string]int64)
+var publishedLastSeen = make(map[string]int64)
+
+// noteAreaActivity keeps track of the last time anything in the
+// area was triggered. The caller must hold the mutex
+func noteAreaActivity(e message.Event) {
+	if len(e.Area) == 0 {
+		return
+	}
+	if e.Timestamp > areaLastSeen[e.Area] {
+		areaLastSeen[e.Area] = e.Timestamp
+	}
+}
+
+// buildAreaTimeline works out which areas are occupied from the
+// sensors that are on, and sends a message for each area that has
+// changed since last time (or every occupied area if it's time for
+// a heartbeat). It's called from buildTimeline(), which holds the mutex
+func buildAreaTimeline(heartbeat bool) {
+	// Which sensors are on in each area
+	occupied := make(map[string][]string)
+	for k := range liveSensors {
+		if e, ok := sensorMap[k]; ok && len(e.Area) > 0 {
+			occupied[e.Area] = append(occupied[e.Area], k)
+		}
+	}
+
+	// Every area that's ever had anything in it triggered is in
+	// areaLastSeen, so that's what we go through
+	for area, ts := range areaLastSeen {
+		sensorsOn, isOccupied := occupied[area]
+
+		update := AreaUpdate{
+			event: message.AreaEvent{
+				Version:   message.Version,
+				Timestamp: ts,
+				Area:      area,
+				State:     message.StateOff,
+				Source:    message.SourceSensorStatus,
+			},
+			kind: updateSteady,
+		}
+
+		switch {
+		case isOccupied != liveAreas[area]:
+			// The area just became occupied or vacant
+			update.kind = updateTransition
+		case isOccupied && heartbeat:
+			update.kind = updateHeartbeat
+		case ts == publishedLastSeen[area]:
+			// Nothing new to say about this area
+			continue
+		}
+
+		if isOccupied {
+			liveAreas[area] = true
+			sort.Strings(sensorsOn)
+			update.event.State = message.StateOn
+			update.event.Sensors = sensorsOn
+		} else {
+			delete(liveAreas, area)
+		}
+		publishedLastSeen[area] = ts
+
+		areaStatusChannel <- update
+	}
+}
+
+// This function sends each area message to the MQTT server, along
+// with the retained state and last seen time for the area
+func sendAreaStatusMessage() {
+	for {
+		update := <-areaStatusChannel
+		areaMsg := update.event
+
+		if update.kind != updateSteady {
+			payload, err := areaMsg.Marshal()
+			if err != nil {
+				log.Printf("Could not build message for %s: %v\n", areaMsg.Area, err)
+			} else {
+				fmt.Println("Gonna send this: ", string(payload))
+				publishToTopic(areaTopic(areaMsg.Area), string(payload))
+			}
+			publishRetained(retainedAreaTopic(areaMsg.Area, "state"), strconv.Itoa(areaMsg.State))
+		}
+
+		publishRetained(retainedAreaTopic(areaMsg.Area, "last_seen"), strconv.FormatInt(areaMsg.Timestamp, 10))
+	}
+}
+
+// areaTopic is the topic we publish the area's messages on, or
+// nothing if we've been told not to publish areas
+func areaTopic(area string) string {
+	if len(cfg.Topics.Area) == 0 {
+		return ""
+	}
+	return cfg.Topics.Area + "/" + message.TopicName(area)
+}
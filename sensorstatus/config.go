@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pumpingstationone/shopmon/shared/mqttclient"
+)
+
+// Config is everything that can be set in config.ini, the
+// environment or on the command line (see the shared/config package)
+type Config struct {
+	MQTT    mqttclient.Options
+	Topics  TopicConfig
+	Status  StatusConfig
+	Sensors SensorConfig
+}
+
+// TopicConfig is the MQTT topics we listen and publish on
+type TopicConfig struct {
+	// The topic to listen on. This is specific to how your
+	// topics are set up on the server. You can listen to more
+	// than one at a time in a hierarchy with the octothorp ("#")
+	// character (e.g. "/occupancy/#" )
+	Sensors string `help:"topic the sensors publish on"`
+	// This is the topic name that we are going to put our new entry
+	// on as JSON (see the shared/message package)
+	Status string `help:"topic to publish JSON status on"`
+	// This is the topic name that we are going to put our new entry
+	// on, in the old comma-separated form
+	Legacy string `help:"topic to publish comma-separated status on"`
+	// The area messages go on this topic with the area name on
+	// the end (e.g. "shopmon/area/Woodshop"; see area.go)
+	Area string `help:"topic prefix to publish area occupancy on"`
+	// The current state of every sensor and area is kept on retained
+	// topics under this prefix (e.g. "shopmon/sensor/Woodshop-1/state";
+	// see retained.go)
+	Retained string `help:"topic prefix for the retained sensor and area state"`
+	// Doors opening and closing go on this topic with the door's
+	// name on the end (e.g. "shopmon/door/Dock-Door"; see door.go)
+	Door string `help:"topic prefix to publish doors opening and closing on"`
+	// Whether each of the status topics above gets every sensor that's on
+	// every second ("level"), or just the changes ("edge")
+	StatusMode string `help:"level or edge"`
+	LegacyMode string `help:"level or edge"`
+}
+
+// How the status topics are published
+const (
+	// Every sensor that's on, every second, plus the ones that
+	// just went off
+	modeLevel = "level"
+	// Only sensors that just went on or off, plus a heartbeat
+	// of everything that's on
+	modeEdge = "edge"
+)
+
+// StatusConfig controls how we decide whether a sensor is on or off
+type StatusConfig struct {
+	// How long an 'active' status message can live before
+	// it's expired, unless the policy file says otherwise
+	Expiry time.Duration `help:"how long a sensor stays on after it's triggered"`
+	// The per-sensor, per-area and per-type expiry (see policy.go)
+	PolicyFile string `help:"JSON file of expiry times per sensor, area or type"`
+	// How often the edge-triggered topics get a reminder of every
+	// sensor that's on
+	Heartbeat time.Duration `help:"how often to send every sensor that's on to edge-triggered topics"`
+}
+
+// SensorConfig is where we find out about the sensors
+type SensorConfig struct {
+	File string `help:"the sensors.json file from the sensors program"`
+}
+
+// defaultConfig is what we use if nothing else is given
+func defaultConfig() Config {
+	return Config{
+		MQTT: mqttclient.Options{
+			Broker: "tcp://10.10.1.224:1883",
+			// The clientID must be a unique name for listening on the
+			// topics, otherwise you may get disconnect errors. We use
+			// the same connection for listening and publishing
+			ClientID: "sensorstatus",
+		},
+		Topics: TopicConfig{
+			Sensors:  "shopmontopic",
+			Status:   "shopmon/status",
+			Legacy:   "webshopmontopic",
+			Area:     "shopmon/area",
+			Retained: "shopmon",
+			Door:     "shopmon/door",
+			// The website and bot expect to hear about everything
+			// that's on every second, so that's the default
+			StatusMode: modeLevel,
+			LegacyMode: modeLevel,
+		},
+		Status: StatusConfig{
+			Expiry:     10 * time.Second,
+			PolicyFile: "policies.json",
+			Heartbeat:  time.Minute,
+		},
+		Sensors: SensorConfig{
+			File: "../sensors/sensors.json",
+		},
+	}
+}
+
+// Validate checks the parts of the config that are ours
+func (c *Config) Validate() error {
+	if len(c.Topics.Sensors) == 0 {
+		return errors.New("no sensor topic given")
+	}
+	if len(c.Topics.Status) == 0 && len(c.Topics.Legacy) == 0 {
+		return errors.New("need at least one of the status or legacy topics to publish on")
+	}
+	for _, mode := range []string{c.Topics.StatusMode, c.Topics.LegacyMode} {
+		if mode != modeLevel && mode != modeEdge {
+			return fmt.Errorf("topic mode has to be %q or %q, not %q", modeLevel, modeEdge, mode)
+		}
+	}
+	if c.Status.Heartbeat < time.Second {
+		return errors.New("heartbeat has to be at least a second")
+	}
+	if c.Status.Expiry < time.Second {
+		return errors.New("expiry has to be at least a second")
+	}
+	return nil
+}
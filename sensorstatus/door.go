@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pumpingstationone/shopmon/shared/message"
+)
+
+/*
+ * The panel reports a door (or window) as faulted over and over for as long
+ * as it's open, which on its own just looks like a lot of activations. What
+ * we actually want to know is whether the door is open, and for how long,
+ * since a dock door left open overnight is a problem. So a door is open from
+ * the first time the panel reports it until the panel has stopped reporting
+ * it for the door's expiry (see policy.go; "kinds": {"door": ...} in the
+ * policy file), and every time a door opens or closes we publish a message
+ * on <door topic>/<door name> (e.g. "shopmon/door/Dock-Door"):
+ *
+ *	{"v":1,"ts":1597446363,"door":"Dock-Door","area":"Dock Door","state":1,"opened_at":1597446363}
+ *
+ * and when it closes, with the state set to 0 and "duration" set to how
+ * many seconds it was open for. The messages are retained, so anything that
+ * subscribes gets the current state of every door straight away.
+ */
+
+// The channel we are going to use to send the door messages to
+// the MQTT server
+var doorStatusChannel chan message.DoorEvent
+
+// When each door that's open was opened; guarded by the same
+// mutex as sensorMap
+var doorOpenedAt = make(map[string]int64)
+
+// isDoor reports whether the sensor in the event is something that
+// opens, going by sensors.json if it knows the sensor
+func isDoor(e message.Event) bool {
+	kind := e.Kind
+	if sensor, ok := sensors.Lookup(e.Sensor); ok {
+		kind = sensor.Kind
+	}
+	return message.IsOpening(kind)
+}
+
+// noteDoorTransition is called from buildTimeline(), which holds the
+// mutex, whenever a sensor goes on or off. If the sensor is a door,
+// we send a message saying that it's opened or closed
+func noteDoorTransition(e message.Event, open bool) {
+	if !isDoor(e) {
+		return
+	}
+
+	doorMsg := message.DoorEvent{
+		Version:   message.Version,
+		Timestamp: e.Timestamp,
+		Door:      e.Sensor,
+		Area:      e.Area,
+		State:     message.StateOff,
+		Source:    message.SourceSensorStatus,
+	}
+
+	if open {
+		// The timestamp is the first time the panel reported it
+		doorOpenedAt[e.Sensor] = e.Timestamp
+		doorMsg.State = message.StateOn
+		doorMsg.OpenedAt = e.Timestamp
+	} else {
+		// The timestamp is the last time the panel reported it, which
+		// is as close as we can get to when it was closed
+		openedAt, ok := doorOpenedAt[e.Sensor]
+		if !ok {
+			openedAt = e.Timestamp
+		}
+		delete(doorOpenedAt, e.Sensor)
+		doorMsg.OpenedAt = openedAt
+		doorMsg.Duration = e.Timestamp - openedAt
+	}
+
+	doorStatusChannel <- doorMsg
+}
+
+// This function sends each door message to the MQTT server
+func sendDoorStatusMessage() {
+	for {
+		doorMsg := <-doorStatusChannel
+
+		payload, err := doorMsg.Marshal()
+		if err != nil {
+			log.Printf("Could not build message for %s: %v\n", doorMsg.Door, err)
+			continue
+		}
+
+		if doorMsg.Open() {
+			fmt.Printf("%s is open\n", doorMsg.Door)
+		} else {
+			fmt.Printf("%s is closed after %s\n", doorMsg.Door, doorMsg.OpenFor(time.Now()))
+		}
+
+		publishDoor(doorMsg.Door, payload)
+	}
+}
+
+// publishDoor publishes the door's message on its retained topic
+func publishDoor(door string, payload []byte) {
+	if len(cfg.Topics.Door) == 0 {
+		return
+	}
+	if err := client.Publish(doorTopic(door), payload, true); err != nil {
+		log.Println(err)
+	}
+}
+
+// doorTopic is the topic we publish the door's messages on
+func doorTopic(door string) string {
+	return cfg.Topics.Door + "/" + message.TopicName(door)
+}
+
+// resetDoors marks every door we know about as closed. Like
+// resetRetained(), we've only just started so as far as we know
+// nothing is open, and if it is the panel will tell us soon enough
+func resetDoors() {
+	now := time.Now().Unix()
+	for _, s := range sensors.Sensors() {
+		if !message.IsOpening(s.Kind) {
+			continue
+		}
+		doorMsg := message.DoorEvent{
+			Version:   message.Version,
+			Timestamp: now,
+			Door:      s.Name,
+			Area:      s.Area,
+			State:     message.StateOff,
+			OpenedAt:  now,
+			Source:    message.SourceSensorStatus,
+		}
+		if payload, err := doorMsg.Marshal(); err == nil {
+			publishDoor(s.Name, payload)
+		}
+	}
+}
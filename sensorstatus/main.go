@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"os"
+	"os/signal"
 	"strconv"
-	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"github.com/pumpingstationone/shopmon/shared/config"
+	"github.com/pumpingstationone/shopmon/shared/message"
+	"github.com/pumpingstationone/shopmon/shared/registry"
 )
 
 /*
@@ -25,120 +33,265 @@ type StatusMessage struct {
 // Our channel that accepts StatusMessages from the MQTT server
 var statusChannel chan StatusMessage
 
+// The kinds of status update we send. Level-triggered topics get every
+// sensor that's on, every second, along with the ones that just went off.
+// Edge-triggered topics only get told when a sensor changes state, plus
+// a heartbeat every so often with every sensor that's on
+const (
+	// The sensor is in the same state it was a second ago
+	updateSteady = iota
+	// The sensor just went on or off
+	updateTransition
+	// A reminder of a sensor that's on, for edge-triggered topics
+	updateHeartbeat
+)
+
+// StatusUpdate is a message for the MQTT server and what kind of
+// update it is, so we know which topics it should go to
+type StatusUpdate struct {
+	event message.Event
+	kind  int
+}
+
 // The channel we are going to use to send the new messages to
 // the MQTT server
-var fullStatusChannel chan string
+var fullStatusChannel chan StatusUpdate
 
 // The map and guard that we use to keep track of what
-// sensors we've seen and their timestamps
-var sensorMap map[string]time.Time
+// sensors we've seen; the key is the sensor name and the
+// value is the latest event we got for it
+var sensorMap map[string]message.Event
 var mutex = &sync.Mutex{}
 
-// The time, in seconds, of how long an 'active' status message
-// can live before it's expired
-const expiry = 10
+// The sensors we've told everyone are on; also guarded by
+// the mutex above
+var liveSensors = make(map[string]bool)
+
+// Our settings (see config.go)
+var cfg = defaultConfig()
+
+// How long each sensor stays on (see policy.go)
+var policy *ExpiryPolicy
+
+// Every sensor we know about, from sensors.json
+var sensors *registry.Registry
 
 // This function goes through the sensorMap every second and
 // checks to see what messages have expired (i.e. their timestamps
-// are older than the expiry constant above). It builds a message line
-// with either a 0 or 1 at the end to indicate that the sensor message
-// has expired (i.e. there's no one there) or that there is still someone
-// there, respectively
+// are older than the expiry for that sensor in the policy). It builds a message
+// with the state set to either StateOff or StateOn to indicate that
+// the sensor message has expired (i.e. there's no one there) or that
+// there is still someone there, respectively. It also keeps track of
+// which sensors have just changed state, and every Heartbeat it sends
+// a reminder of every sensor that's on for the edge-triggered topics
 func buildTimeline() {
+	lastHeartbeat := time.Now()
 	for {
-		newLine := ""
 		time.Sleep(1 * time.Second)
 		now := time.Now()
+
+		heartbeat := false
+		if now.Sub(lastHeartbeat) >= cfg.Status.Heartbeat {
+			heartbeat = true
+			lastHeartbeat = now
+		}
+
 		if len(sensorMap) > 0 {
 			mutex.Lock()
 			for k, v := range sensorMap {
 				// compare the current timestamp to that
 				// in the map...
-				diff := now.Sub(v)
-				seconds := int(diff.Seconds())
+				diff := now.Sub(v.Time())
+				// The message we send on is the same as the one
+				// we got, just from us and with the state set
+				update := StatusUpdate{event: v, kind: updateSteady}
+				update.event.Source = message.SourceSensorStatus
 				// has the message expired?
-				if seconds > expiry {
+				if diff.Truncate(time.Second) > policy.expiryFor(v) {
 					// Yes, so remove it from the map and...
 					delete(sensorMap, k)
-					// ...send the line with 0
-					newLine = strconv.FormatInt(v.Unix(), 10) + "," + k + ",0"
+					delete(liveSensors, k)
+					// ...send it as off
+					update.event.State = message.StateOff
+					update.kind = updateTransition
+					// (and if it's a door, it's now closed)
+					noteDoorTransition(update.event, false)
 				} else {
 					// No, the message is still alive
-					newLine = strconv.FormatInt(v.Unix(), 10) + "," + k + ",1"
+					update.event.State = message.StateOn
+					// ...but is this the first we've heard of it?
+					if !liveSensors[k] {
+						liveSensors[k] = true
+						update.kind = updateTransition
+						noteDoorTransition(update.event, true)
+					}
 				}
 
 				// And send the message on its merry way
-				fullStatusChannel <- newLine
+				fullStatusChannel <- update
+
+				// The edge-triggered topics also want to be reminded
+				// of everything that's still on every so often
+				if heartbeat && update.kind == updateSteady {
+					update.kind = updateHeartbeat
+					fullStatusChannel <- update
+				}
 			}
+
+			// Now that we know which sensors are on, we can
+			// work out which areas are occupied
+			buildAreaTimeline(heartbeat)
 			mutex.Unlock()
 		}
 	}
 }
 
+// wantsUpdate decides whether a topic in the given mode should
+// get the update
+func wantsUpdate(mode string, kind int) bool {
+	if mode == modeEdge {
+		return kind == updateTransition || kind == updateHeartbeat
+	}
+	return kind == updateSteady || kind == updateTransition
+}
+
+// This function sends each status message to the MQTT server, both
+// as JSON on the status topic and in the old comma-separated form on
+// the legacy topic for anything still reading that, depending on
+// whether each topic is level- or edge-triggered
 func sendFullStatusMessage() {
 	for {
-		fullStatusMsg := <-fullStatusChannel
-		fmt.Println("Gonna send this: ", fullStatusMsg)
-		publishToTopic(fullStatusMsg)
+		update := <-fullStatusChannel
+		fullStatusMsg := update.event
+
+		if wantsUpdate(cfg.Topics.StatusMode, update.kind) {
+			payload, err := fullStatusMsg.Marshal()
+			if err != nil {
+				log.Printf("Could not build message for %s: %v\n", fullStatusMsg.Sensor, err)
+			} else {
+				fmt.Println("Gonna send this: ", string(payload))
+				publishToTopic(cfg.Topics.Status, string(payload))
+			}
+		}
+
+		if wantsUpdate(cfg.Topics.LegacyMode, update.kind) {
+			publishToTopic(cfg.Topics.Legacy, fullStatusMsg.Legacy())
+		}
+
+		// The retained topic only needs to change when the sensor
+		// does, but the heartbeat doesn't hurt in case we missed one
+		if update.kind != updateSteady {
+			publishRetained(retainedSensorTopic(fullStatusMsg.Sensor, "state"), strconv.Itoa(fullStatusMsg.State))
+		}
 	}
 }
 
 func main() {
+	// Read our settings first, as everything depends on them
+	if err := config.Load("sensorstatus", &cfg, os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	// And how long each sensor should stay on
+	var err error
+	policy, err = loadPolicy(cfg.Status.PolicyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// And what sensors we have. If the file isn't there yet we'll
+	// carry on with what's in the messages, and pick it up when it
+	// shows up
+	sensors = registry.New(cfg.Sensors.File)
+	if err := sensors.Reload(); err != nil {
+		log.Println("Could not load sensors:", err)
+	}
+
 	// The channel we're going to receive messages on
 	statusChannel = make(chan StatusMessage)
 	// The channel we're going to send the full data on
-	fullStatusChannel = make(chan string)
-
-	// Start up our publishing connection
-	setupToPublish()
-
-	// Set us up to listen to the topics on the MQTT server...
-	go listenOnTopic()
+	fullStatusChannel = make(chan StatusUpdate)
+	// The channel we're going to send the area data on
+	areaStatusChannel = make(chan AreaUpdate)
+	// And the doors opening and closing
+	doorStatusChannel = make(chan message.DoorEvent)
 
 	// Create our map that will hold the key of sensor name
-	// to its timestamp
-	sensorMap = make(map[string]time.Time)
+	// to its latest event
+	sensorMap = make(map[string]message.Event)
 	// This goroutine reads from the map
 	go buildTimeline()
 	// This goroutine sends the new status message to the MQTT server
 	go sendFullStatusMessage()
+	// And this one sends the area messages
+	go sendAreaStatusMessage()
+	// And this one the doors
+	go sendDoorStatusMessage()
+
+	// Everything runs until we get told to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Set us up to listen to the topics on the MQTT server, and to
+	// publish our own
+	if err := connectToServer(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	// Pick up any changes to sensors.json as they happen
+	go sensors.Watch(ctx)
+
+	// We've only just started, so as far as we know nothing is on
+	// (or open)
+	resetRetained()
+	resetDoors()
 
 	// And here we go!
 	for {
 		// Get our message from the MQTT topic
-		statusMsg := <-statusChannel
+		var statusMsg StatusMessage
+		select {
+		case statusMsg = <-statusChannel:
+		case <-ctx.Done():
+			fmt.Println("Goodbye")
+			return
+		}
 
-		// And split it up into its various parts
-		lineParts := strings.Split(statusMsg.spaceStatus, ",")
-		i, err := strconv.ParseInt(lineParts[0], 10, 64)
+		// And turn it into something we can work with; this
+		// understands both the JSON and the old comma-separated
+		// form of the message
+		event, err := message.Parse([]byte(statusMsg.spaceStatus))
 		if err != nil {
-			panic(err)
+			log.Printf("Ignoring message: %v\n", err)
+			continue
 		}
 
-		// We want to preserve the area the sensor is in, but what is being
-		// sent onward doesn't have access to the original message but for what
-		// is in the map so we are gonna do a little trick and append the area name
-		// to the sensor id so the key is effectively "HotMetals-2:Hot Metals", so
-		// that downstream they'll have both parts and can split on the colon
-		fullKey := lineParts[1] + ":" + lineParts[2]
+		// Fill in the area and zone from sensors.json, which is the
+		// authority on where each sensor is. If we don't know the
+		// sensor, we pass it on as it is, as the sensors program may
+		// have a newer sensors.json than we do
+		if !sensors.Enrich(&event) {
+			log.Printf("%s is not in %s\n", event.Sensor, sensors.Path())
+		}
 
-		// Convert the unix timestamp to a time object for the map
-		tm := time.Unix(i, 0)
+		// We used to have to smuggle the area into the key as
+		// "HotMetals-2:Hot Metals" so that it made it downstream,
+		// but now we keep the whole event around so the key is
+		// just the sensor name
 		mutex.Lock()
 		// Check to see if there's already an entry for this sensor in the map
-		if _, testIfExists := sensorMap[fullKey]; testIfExists {
+		if _, testIfExists := sensorMap[event.Sensor]; testIfExists {
 			// There is an entry, but it has an older timestamp
 			// so we are going to simply delete it, because we know that
 			// the timestamp we have right now is newer than this one (even if
 			// by a second), and that's all we care about
-			delete(sensorMap, fullKey)
+			delete(sensorMap, event.Sensor)
 		}
 		// Now we add our entry into the map so the buildTimeLine() function
 		// can evaulate it
-		sensorMap[fullKey] = tm
+		sensorMap[event.Sensor] = event
+		// And keep track of when the sensor's area was last active
+		noteAreaActivity(event)
 		mutex.Unlock()
 	}
-
-	// Should never get here
-	fmt.Println("Hello world!")
 }
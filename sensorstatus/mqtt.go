@@ -1,79 +1,47 @@
 package main
 
 import (
+	"context"
 	"log"
-	"os"
-	"os/signal"
-	"syscall"
 
-	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pumpingstationone/shopmon/shared/mqttclient"
 )
 
-// MQTTServer is the URL to the MQTT server in the format of
-// "tcp://yourservername:port" (port is typically 1883)
-const mqttServer = "tcp://10.10.1.224:1883"
+// The client we'll use to listen and publish on
+var client *mqttclient.Client
 
-// The topic to listen on. This is specific to how your
-// topics are set up on the server. You can listen to more
-// than one at a time in a hierarchy with the octothorp ("#")
-// character (e.g. "/occupancy/#" )
-const topicName = "shopmontopic"
-
-// The clientID must be a unique name for listening on the
-// topics, otherwise you may get disconnect errors
-const clientID = "sensorstatus"
-
-// This is the topic name that we are going to put our new entry
-// on
-const webTopicName = "webshopmontopic"
-const webClientID = "websensorstatus"
-
-// The client we'll use to publish on
-var client MQTT.Client
-
-func onMessageReceived(client MQTT.Client, message MQTT.Message) {
-	log.Printf("Received message on topic: %s\nMessage: %s\n", message.Topic(), message.Payload())
+func onMessageReceived(topic string, payload []byte) {
+	log.Printf("Received message on topic: %s\nMessage: %s\n", topic, payload)
 	var sm StatusMessage
-	sm.spaceStatus = string(message.Payload())
+	sm.spaceStatus = string(payload)
 
 	// And send it to our channel for processing
 	statusChannel <- sm
 }
 
-func listenOnTopic() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-
-	qos := 0
-
-	connOpts := MQTT.NewClientOptions().AddBroker(mqttServer).SetClientID(clientID).SetCleanSession(true)
-
-	connOpts.OnConnect = func(c MQTT.Client) {
-		if token := c.Subscribe(topicName, byte(qos), onMessageReceived); token.Wait() && token.Error() != nil {
-			panic(token.Error())
-		}
+// connectToServer connects to the MQTT server, subscribes to the
+// sensor topic and gets us ready to publish. The connection is kept
+// alive until the context is cancelled
+func connectToServer(ctx context.Context) error {
+	var err error
+	client, err = mqttclient.New(cfg.MQTT)
+	if err != nil {
+		return err
 	}
 
-	client := MQTT.NewClient(connOpts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
-	} else {
-		log.Printf("Connected to %s to listen\n", mqttServer)
+	if err := client.Subscribe(cfg.Topics.Sensors, onMessageReceived); err != nil {
+		return err
 	}
 
-	<-c
+	return client.Connect(ctx)
 }
 
-func setupToPublish() {
-	connOpts := MQTT.NewClientOptions().AddBroker(mqttServer).SetClientID(webClientID).SetCleanSession(true)
-	client = MQTT.NewClient(connOpts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
-	} else {
-		log.Printf("Connected to %s to publish\n", mqttServer)
+func publishToTopic(topic string, message string) {
+	// An empty topic means we've been told not to publish there
+	if len(topic) == 0 {
+		return
+	}
+	if err := client.Publish(topic, []byte(message), false); err != nil {
+		log.Println(err)
 	}
-}
-
-func publishToTopic(message string) {
-	client.Publish(webTopicName, 0, false, message)
 }
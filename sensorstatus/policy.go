@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pumpingstationone/shopmon/shared/config"
+	"github.com/pumpingstationone/shopmon/shared/message"
+)
+
+/*
+ * Not every sensor should stay on for the same amount of time after it's
+ * triggered. A PIR sensor in a big room like the Woodshop won't see someone
+ * standing still at the table saw, so it should hold on longer than one in
+ * a small room, and a door contact is reported by the panel over and over
+ * for as long as the door is open, so it should stay on for as long as the
+ * panel keeps telling us about it.
+ *
+ * The policy file lets us set the expiry per sensor, per area or per kind
+ * of sensor (the "kind" in sensors.json, which we get from the registry), e.g.
+ *
+ *	{
+ *	  "sensors": { "Woodshop-3": "20s" },
+ *	  "areas":   { "Woodshop": "30s" },
+ *	  "kinds":   { "door": "30s" }
+ *	}
+ *
+ * The most specific one wins, and anything not in the file gets the
+ * Expiry from the config.
+ */
+
+// ExpiryPolicy is the table of how long each sensor stays on
+type ExpiryPolicy struct {
+	Sensors map[string]config.Duration `json:"sensors"`
+	Areas   map[string]config.Duration `json:"areas"`
+	Kinds   map[string]config.Duration `json:"kinds"`
+}
+
+// loadPolicy reads the policy file. The file can be missing, in which
+// case every sensor just gets the default expiry
+func loadPolicy(policyFile string) (*ExpiryPolicy, error) {
+	policy := &ExpiryPolicy{}
+
+	if len(policyFile) > 0 {
+		data, err := os.ReadFile(policyFile)
+		if err == nil {
+			if err := json.Unmarshal(data, policy); err != nil {
+				return nil, fmt.Errorf("bad policy file %s: %v", policyFile, err)
+			}
+			if err := policy.checkKinds(); err != nil {
+				return nil, fmt.Errorf("bad policy file %s: %v", policyFile, err)
+			}
+			if err := policy.checkExpiries(); err != nil {
+				return nil, fmt.Errorf("bad policy file %s: %v", policyFile, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return policy, nil
+}
+
+// checkKinds makes sure the kinds are all kinds of sensor we know
+// about, so that a typo doesn't quietly leave a kind with the default
+// expiry
+func (p *ExpiryPolicy) checkKinds() error {
+	for kind := range p.Kinds {
+		if !message.IsKnownKind(kind) {
+			return fmt.Errorf("%q isn't a kind of sensor", kind)
+		}
+	}
+	return nil
+}
+
+// checkExpiries makes sure every expiry is at least a second, as
+// that's how often we check them
+func (p *ExpiryPolicy) checkExpiries() error {
+	for _, expiries := range []map[string]config.Duration{p.Sensors, p.Areas, p.Kinds} {
+		for name, d := range expiries {
+			if time.Duration(d) < time.Second {
+				return fmt.Errorf("expiry %s for %s is less than a second", time.Duration(d), name)
+			}
+		}
+	}
+	return nil
+}
+
+// expiryFor returns how long the sensor in the event should stay
+// on after it was last triggered
+func (p *ExpiryPolicy) expiryFor(e message.Event) time.Duration {
+	if d, ok := p.Sensors[e.Sensor]; ok {
+		return time.Duration(d)
+	}
+	if d, ok := p.Areas[e.Area]; ok {
+		return time.Duration(d)
+	}
+	kind := e.Kind
+	if sensor, ok := sensors.Lookup(e.Sensor); ok {
+		kind = sensor.Kind
+	}
+	if d, ok := p.Kinds[kind]; ok {
+		return time.Duration(d)
+	}
+	return cfg.Status.Expiry
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+
+	"github.com/pumpingstationone/shopmon/shared/message"
+)
+
+/*
+ * Anything that subscribes to the status or area topics has no idea what's
+ * going on until the next message comes along. So we also keep the current
+ * state on retained topics, which the MQTT server hangs on to and hands to
+ * anyone who subscribes, so that Home Assistant, Node-RED and the like get
+ * the full picture as soon as they connect:
+ *
+ *	shopmon/sensor/<sensor>/state    1 if the sensor is on, 0 if not
+ *	shopmon/area/<area>/state        1 if the area is occupied, 0 if not
+ *	shopmon/area/<area>/last_seen    unix timestamp of the last time anything
+ *	                                 in the area was triggered
+ *
+ * The "shopmon" at the front is the Retained setting in the Topics section
+ * of the config; setting it to nothing turns all this off.
+ */
+
+// retainedSensorTopic is the retained topic for something about a sensor
+func retainedSensorTopic(sensor string, what string) string {
+	return cfg.Topics.Retained + "/sensor/" + message.TopicName(sensor) + "/" + what
+}
+
+// retainedAreaTopic is the retained topic for something about an area
+func retainedAreaTopic(area string, what string) string {
+	return cfg.Topics.Retained + "/area/" + message.TopicName(area) + "/" + what
+}
+
+// publishRetained publishes the value on the topic and asks the MQTT
+// server to keep it for anyone who subscribes later
+func publishRetained(topic string, value string) {
+	if len(cfg.Topics.Retained) == 0 {
+		return
+	}
+	if err := client.Publish(topic, []byte(value), true); err != nil {
+		log.Println(err)
+	}
+}
+
+// resetRetained marks every sensor and area we know about as off.
+// When we start up we don't know of anything that's on, and we don't
+// want what we left behind last time to stick around until each
+// sensor changes. The last seen times are still right, so those stay
+func resetRetained() {
+	for _, s := range sensors.Sensors() {
+		publishRetained(retainedSensorTopic(s.Name, "state"), "0")
+	}
+	for _, area := range sensors.Areas() {
+		publishRetained(retainedAreaTopic(area, "state"), "0")
+	}
+}
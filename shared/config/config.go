@@ -0,0 +1,306 @@
+// Package config loads the settings for a shopmon program from, in
+// increasing order of precedence:
+//
+//   - the defaults the program starts with
+//   - an INI file (config.ini unless -config says otherwise)
+//   - environment variables (e.g. SHOPMON_MQTT_BROKER)
+//   - command line flags (e.g. -mqtt.broker)
+//
+// The settings are a struct of sections, each of which is a struct of
+// keys, the same way gopkg.in/ini.v1 maps a file onto a struct, e.g.
+//
+//	type Config struct {
+//		MQTT mqttclient.Options
+//		Web  struct {
+//			Addr string `help:"http service address"`
+//		}
+//	}
+//
+// The section and key names are the field names unless there's an
+// `ini` tag. Keys can also have a `help` tag for the flag's usage
+// text, a `flag` tag to give the flag a shorter name (e.g. "addr"),
+// and `secret:"true"` to keep the value out of -print-config.
+//
+// Any section (or the whole struct) with a Validate() error method
+// gets checked once everything is loaded.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// The prefix for all environment variables
+const envPrefix = "SHOPMON"
+
+// The config file we look for if we're not told otherwise
+const defaultFile = "config.ini"
+
+// Validator is implemented by settings that can check themselves
+type Validator interface {
+	Validate() error
+}
+
+// setting is a single key in a section, along with everything we
+// need to know to set it from the environment or a flag
+type setting struct {
+	section string
+	key     string
+	help    string
+	flag    string
+	secret  bool
+	value   reflect.Value
+}
+
+func (s setting) envName() string {
+	return envPrefix + "_" + strings.ToUpper(s.section) + "_" + strings.ToUpper(s.key)
+}
+
+func (s setting) flagName() string {
+	return strings.ToLower(s.section) + "." + strings.ToLower(s.key)
+}
+
+// Load fills in cfg, which must be a pointer to a struct of sections
+// as described at the top of this file. args are the command line
+// arguments, without the program name (i.e. os.Args[1:]).
+//
+// If -print-config is given, the final settings are written to stdout
+// and the program exits.
+func Load(name string, cfg interface{}, args []string) error {
+	settings, err := walk(cfg)
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := flags.String("config", defaultFile, "the config file to read")
+	printConfig := flags.Bool("print-config", false, "print the configuration and exit")
+
+	// The flags are applied last, but we have to parse them first
+	// to find out where the config file is, so we just hang on to
+	// what was given for now
+	given := make(map[string]string)
+	for _, s := range settings {
+		usage := s.help
+		if len(usage) == 0 {
+			usage = fmt.Sprintf("%s %s", s.section, s.key)
+		}
+		usage += fmt.Sprintf(" (env %s)", s.envName())
+		value := &flagValue{name: s.flagName(), given: given, isBool: s.value.Kind() == reflect.Bool}
+		flags.Var(value, s.flagName(), usage)
+		if len(s.flag) > 0 {
+			flags.Var(value, s.flag, "same as -"+s.flagName())
+		}
+	}
+
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		return err
+	}
+
+	// The config file, which only has to exist if we were
+	// specifically asked to read it
+	explicit := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			explicit = true
+		}
+	})
+	if _, err := os.Stat(*configFile); err == nil || explicit {
+		file, err := ini.Load(*configFile)
+		if err != nil {
+			return fmt.Errorf("could not read config file: %v", err)
+		}
+		if err := file.MapTo(cfg); err != nil {
+			return fmt.Errorf("bad config file %s: %v", *configFile, err)
+		}
+	}
+
+	// Then the environment...
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.envName()); ok {
+			if err := set(s.value, v); err != nil {
+				return fmt.Errorf("bad value for %s: %v", s.envName(), err)
+			}
+		}
+	}
+
+	// ...and finally the flags
+	for _, s := range settings {
+		if v, ok := given[s.flagName()]; ok {
+			if err := set(s.value, v); err != nil {
+				return fmt.Errorf("bad value for -%s: %v", s.flagName(), err)
+			}
+		}
+	}
+
+	if *printConfig {
+		write(os.Stdout, settings)
+		os.Exit(0)
+	}
+
+	return validate(cfg)
+}
+
+// flagValue hangs on to whatever was given for a flag so that it can
+// be applied after the config file and environment
+type flagValue struct {
+	name   string
+	given  map[string]string
+	isBool bool
+}
+
+func (f *flagValue) String() string {
+	if f == nil || f.given == nil {
+		return ""
+	}
+	return f.given[f.name]
+}
+
+func (f *flagValue) Set(v string) error {
+	f.given[f.name] = v
+	return nil
+}
+
+// IsBoolFlag lets boolean settings be given as just -name
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// walk goes through the sections and keys in cfg and returns a
+// setting for every key
+func walk(cfg interface{}) ([]setting, error) {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil, errors.New("config must be a pointer to a struct")
+	}
+	v = v.Elem()
+
+	var settings []setting
+	for i := 0; i < v.NumField(); i++ {
+		sectionField := v.Type().Field(i)
+		if sectionField.PkgPath != "" || sectionField.Type.Kind() != reflect.Struct {
+			continue
+		}
+		section := fieldName(sectionField)
+
+		sectionValue := v.Field(i)
+		for j := 0; j < sectionValue.NumField(); j++ {
+			keyField := sectionValue.Type().Field(j)
+			if keyField.PkgPath != "" || keyField.Tag.Get("ini") == "-" {
+				continue
+			}
+			settings = append(settings, setting{
+				section: section,
+				key:     fieldName(keyField),
+				help:    keyField.Tag.Get("help"),
+				flag:    keyField.Tag.Get("flag"),
+				secret:  keyField.Tag.Get("secret") == "true",
+				value:   sectionValue.Field(j),
+			})
+		}
+	}
+
+	return settings, nil
+}
+
+// fieldName is the name of the section or key, which is the same
+// name gopkg.in/ini.v1 uses when it maps the file onto the struct
+func fieldName(f reflect.StructField) string {
+	if name := strings.Split(f.Tag.Get("ini"), ",")[0]; len(name) > 0 {
+		return name
+	}
+	return f.Name
+}
+
+// set parses the string and stores it in the key
+func set(v reflect.Value, raw string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("don't know how to set a %s", v.Type())
+	}
+
+	return nil
+}
+
+// write prints the settings in the same form as the config file, so
+// the output of -print-config can be used as a starting point for one
+func write(w io.Writer, settings []setting) {
+	section := ""
+	for _, s := range settings {
+		if s.section != section {
+			if len(section) > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "[%s]\n", s.section)
+			section = s.section
+		}
+
+		value := fmt.Sprint(s.value.Interface())
+		if s.secret && len(value) > 0 {
+			value = "********"
+		}
+		fmt.Fprintf(w, "%s = %s\n", s.key, value)
+	}
+}
+
+// validate checks each section, and then the whole thing
+func validate(cfg interface{}) error {
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).PkgPath != "" {
+			continue
+		}
+		if validator, ok := v.Field(i).Addr().Interface().(Validator); ok {
+			if err := validator.Validate(); err != nil {
+				return fmt.Errorf("[%s] %v", fieldName(v.Type().Field(i)), err)
+			}
+		}
+	}
+
+	if validator, ok := cfg.(Validator); ok {
+		return validator.Validate()
+	}
+
+	return nil
+}
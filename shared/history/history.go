@@ -0,0 +1,194 @@
+// Package history keeps a record of sensor activity in a SQLite
+// database, so that we can look back at how the space has been used
+// instead of only knowing when each area was last seen.
+//
+// Two things are recorded:
+//
+//   - activations, one row every time a sensor was triggered
+//   - intervals, one row for each stretch of time a sensor was on,
+//     from when sensorstatus first said it was on until it said it
+//     was off again
+//
+// sensorstatus sends the same message every second for as long as a
+// sensor is on (unless its topic is edge-triggered), so activations
+// are only recorded once per sensor per timestamp, and an interval is
+// only started when a sensor that was off comes on.
+package history
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	// The SQLite driver for database/sql
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/pumpingstationone/shopmon/shared/message"
+)
+
+// The tables, which are created if they aren't there already. All of
+// the times are unix timestamps, and end is NULL for an interval that
+// hasn't finished yet
+const schema = `
+CREATE TABLE IF NOT EXISTS activations (
+	id     INTEGER PRIMARY KEY,
+	sensor TEXT NOT NULL,
+	area   TEXT NOT NULL,
+	ts     INTEGER NOT NULL,
+	UNIQUE (sensor, ts)
+);
+CREATE INDEX IF NOT EXISTS activations_area_ts ON activations (area, ts);
+
+CREATE TABLE IF NOT EXISTS intervals (
+	id        INTEGER PRIMARY KEY,
+	sensor    TEXT NOT NULL,
+	area      TEXT NOT NULL,
+	start     INTEGER NOT NULL,
+	last_seen INTEGER NOT NULL,
+	end       INTEGER
+);
+CREATE INDEX IF NOT EXISTS intervals_area_start ON intervals (area, start);
+CREATE INDEX IF NOT EXISTS intervals_sensor_start ON intervals (sensor, start);
+`
+
+// openInterval is what we need to know about an interval that's
+// still going
+type openInterval struct {
+	id       int64
+	lastSeen int64
+}
+
+// DB is the history database
+type DB struct {
+	db *sql.DB
+
+	mutex sync.Mutex
+	open  map[string]openInterval
+}
+
+// Open opens (or creates) the database at path. Any intervals that
+// were still going the last time the database was used are ended at
+// the last time their sensor was seen, as we don't know what happened
+// after that.
+func Open(path string) (*DB, error) {
+	// SQLite only lets one connection write at a time, so we wait
+	// a while for the lock rather than failing straight away
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	if path == ":memory:" {
+		// Every connection to :memory: gets its own empty database,
+		// so we can only have the one
+		db.SetMaxOpenConns(1)
+	}
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not set up %s: %v", path, err)
+	}
+
+	if _, err := db.Exec(`UPDATE intervals SET end = last_seen WHERE end IS NULL`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not end old intervals in %s: %v", path, err)
+	}
+
+	return &DB{
+		db:   db,
+		open: make(map[string]openInterval),
+	}, nil
+}
+
+// Close ends every interval that's still going at the last time its
+// sensor was seen, and closes the database
+func (h *DB) Close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for sensor, interval := range h.open {
+		if err := h.endInterval(interval, interval.lastSeen); err != nil {
+			log.Println(err)
+		}
+		delete(h.open, sensor)
+	}
+
+	return h.db.Close()
+}
+
+// RecordActivation records that the sensor in the event was triggered
+// at the event's timestamp. Recording the same activation twice is
+// harmless.
+func (h *DB) RecordActivation(e message.Event) error {
+	_, err := h.db.Exec(`INSERT OR IGNORE INTO activations (sensor, area, ts) VALUES (?, ?, ?)`,
+		e.Sensor, e.Area, e.Timestamp)
+	if err != nil {
+		return fmt.Errorf("could not record activation of %s: %v", e.Sensor, err)
+	}
+	return nil
+}
+
+// RecordStatus records a status message from sensorstatus that we got
+// at the given time. A sensor that's on starts an interval (if it isn't
+// in one already) and a sensor that's off ends it.
+func (h *DB) RecordStatus(e message.Event, at time.Time) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	interval, isOpen := h.open[e.Sensor]
+
+	if !e.On() {
+		if !isOpen {
+			return nil
+		}
+		delete(h.open, e.Sensor)
+		return h.endInterval(interval, at.Unix())
+	}
+
+	// The timestamp is the last time the sensor was triggered, so
+	// it's an activation too
+	if err := h.RecordActivation(e); err != nil {
+		return err
+	}
+
+	if isOpen {
+		// The same message again, which is what we get every
+		// second in level mode, so there's nothing new
+		if e.Timestamp <= interval.lastSeen {
+			return nil
+		}
+		interval.lastSeen = e.Timestamp
+		h.open[e.Sensor] = interval
+		_, err := h.db.Exec(`UPDATE intervals SET last_seen = ? WHERE id = ?`, e.Timestamp, interval.id)
+		if err != nil {
+			return fmt.Errorf("could not update interval for %s: %v", e.Sensor, err)
+		}
+		return nil
+	}
+
+	result, err := h.db.Exec(`INSERT INTO intervals (sensor, area, start, last_seen) VALUES (?, ?, ?, ?)`,
+		e.Sensor, e.Area, e.Timestamp, e.Timestamp)
+	if err != nil {
+		return fmt.Errorf("could not start interval for %s: %v", e.Sensor, err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	h.open[e.Sensor] = openInterval{id: id, lastSeen: e.Timestamp}
+
+	return nil
+}
+
+// endInterval sets the end of the interval, which is never before
+// its sensor was last seen. The caller must hold the mutex
+func (h *DB) endInterval(interval openInterval, end int64) error {
+	if end < interval.lastSeen {
+		end = interval.lastSeen
+	}
+	if _, err := h.db.Exec(`UPDATE intervals SET end = ? WHERE id = ?`, end, interval.id); err != nil {
+		return fmt.Errorf("could not end interval %d: %v", interval.id, err)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package history
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The start of the test queries, on a whole hour so the buckets are
+// easy to follow
+const testFrom = 1600000000 - 1600000000%3600
+
+// openTestDB opens an empty in-memory database
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	h, err := Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// addInterval adds an interval that ran from start to end, in seconds
+// after testFrom
+func addInterval(t *testing.T, h *DB, sensor, area string, start, end int64) {
+	t.Helper()
+	_, err := h.db.Exec(`INSERT INTO intervals (sensor, area, start, last_seen, end) VALUES (?, ?, ?, ?, ?)`,
+		sensor, area, testFrom+start, testFrom+start, testFrom+end)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addActivation adds an activation at ts seconds after testFrom
+func addActivation(t *testing.T, h *DB, sensor, area string, ts int64) {
+	t.Helper()
+	_, err := h.db.Exec(`INSERT INTO activations (sensor, area, ts) VALUES (?, ?, ?)`,
+		sensor, area, testFrom+ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// occupied is just the occupied seconds of each bucket
+func occupied(buckets []Bucket) []int64 {
+	var seconds []int64
+	for _, b := range buckets {
+		seconds = append(seconds, b.OccupiedSeconds)
+	}
+	return seconds
+}
+
+func TestBucketsCrossingEdges(t *testing.T) {
+	h := openTestDB(t)
+	// Starts before the query and ends in the first bucket
+	addInterval(t, h, "Woodshop-1", "Woodshop", -30, 20)
+	// Runs across the edge between the second and third buckets
+	addInterval(t, h, "Woodshop-1", "Woodshop", 100, 130)
+	// Runs past the end of the query
+	addInterval(t, h, "Woodshop-1", "Woodshop", 170, 400)
+	// Somewhere else entirely
+	addInterval(t, h, "Dock-Door", "Dock", 0, 180)
+
+	buckets, err := h.Buckets(Query{
+		Area:   "Woodshop",
+		From:   time.Unix(testFrom, 0),
+		To:     time.Unix(testFrom+180, 0),
+		Bucket: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int64{20, 20, 20}; !reflect.DeepEqual(occupied(buckets), want) {
+		t.Errorf("occupied seconds are %v, want %v", occupied(buckets), want)
+	}
+	for i, b := range buckets {
+		if want := time.Unix(testFrom+int64(i)*60, 0); !b.Start.Equal(want) {
+			t.Errorf("bucket %d starts at %v, want %v", i, b.Start, want)
+		}
+	}
+}
+
+func TestBucketsPartialLastBucket(t *testing.T) {
+	h := openTestDB(t)
+	addInterval(t, h, "Woodshop-1", "Woodshop", 0, 150)
+
+	// 150 seconds in buckets of a minute leaves half a bucket at the
+	// end, which only counts up to the end of the query
+	buckets, err := h.Buckets(Query{
+		From:   time.Unix(testFrom, 0),
+		To:     time.Unix(testFrom+150, 0),
+		Bucket: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{60, 60, 30}; !reflect.DeepEqual(occupied(buckets), want) {
+		t.Errorf("occupied seconds are %v, want %v", occupied(buckets), want)
+	}
+}
+
+func TestBucketsOpenInterval(t *testing.T) {
+	h := openTestDB(t)
+
+	// A sensor that came on and hasn't gone off yet counts as on
+	// until now, even though it was last seen a while ago
+	to := time.Now().Unix()
+	from := to - 180
+	_, err := h.db.Exec(`INSERT INTO intervals (sensor, area, start, last_seen) VALUES (?, ?, ?, ?)`,
+		"Woodshop-1", "Woodshop", from+100, from+110)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buckets, err := h.Buckets(Query{
+		Sensor: "Woodshop-1",
+		From:   time.Unix(from, 0),
+		To:     time.Unix(to, 0),
+		Bucket: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{0, 20, 60}; !reflect.DeepEqual(occupied(buckets), want) {
+		t.Errorf("occupied seconds are %v, want %v", occupied(buckets), want)
+	}
+}
+
+func TestBucketsOverlappingIntervals(t *testing.T) {
+	h := openTestDB(t)
+	// Two sensors in the same area on at the same time only count once
+	addInterval(t, h, "Woodshop-1", "Woodshop", 10, 70)
+	addInterval(t, h, "Woodshop-2", "Woodshop", 40, 100)
+	// And one inside the other doesn't add anything
+	addInterval(t, h, "Woodshop-3", "Woodshop", 50, 60)
+	addActivation(t, h, "Woodshop-1", "Woodshop", 10)
+	addActivation(t, h, "Woodshop-2", "Woodshop", 40)
+	addActivation(t, h, "Woodshop-2", "Woodshop", 99)
+
+	buckets, err := h.Buckets(Query{
+		Area:   "Woodshop",
+		From:   time.Unix(testFrom, 0),
+		To:     time.Unix(testFrom+120, 0),
+		Bucket: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{50, 40}; !reflect.DeepEqual(occupied(buckets), want) {
+		t.Errorf("occupied seconds are %v, want %v", occupied(buckets), want)
+	}
+	if buckets[0].Activations != 2 || buckets[1].Activations != 1 {
+		t.Errorf("activations are %d and %d, want 2 and 1", buckets[0].Activations, buckets[1].Activations)
+	}
+}
+
+func TestBucketsBadQueries(t *testing.T) {
+	h := openTestDB(t)
+	from := time.Unix(testFrom, 0)
+
+	tests := []struct {
+		name string
+		q    Query
+	}{
+		{"end before start", Query{From: from, To: from.Add(-time.Hour), Bucket: time.Minute}},
+		{"no time at all", Query{From: from, To: from, Bucket: time.Minute}},
+		{"bucket too short", Query{From: from, To: from.Add(time.Hour), Bucket: 500 * time.Millisecond}},
+		{"bucket not whole seconds", Query{From: from, To: from.Add(time.Hour), Bucket: 1500 * time.Millisecond}},
+		{"too many buckets", Query{From: from, To: from.Add(365 * 24 * time.Hour), Bucket: time.Minute}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := h.Buckets(test.q); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestMergeSpans(t *testing.T) {
+	tests := []struct {
+		name  string
+		spans []span
+		want  []span
+	}{
+		{"nothing", nil, nil},
+		{"apart", []span{{0, 10}, {20, 30}}, []span{{0, 10}, {20, 30}}},
+		{"out of order", []span{{20, 30}, {0, 10}}, []span{{0, 10}, {20, 30}}},
+		{"overlapping", []span{{0, 10}, {5, 15}}, []span{{0, 15}}},
+		{"touching", []span{{0, 10}, {10, 20}}, []span{{0, 20}}},
+		{"inside another", []span{{0, 30}, {5, 10}, {20, 25}}, []span{{0, 30}}},
+		{"chained", []span{{10, 20}, {0, 12}, {18, 40}, {50, 60}}, []span{{0, 40}, {50, 60}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := mergeSpans(test.spans); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("mergeSpans(%v) = %v, want %v", test.spans, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package history
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Profile is what a typical week looks like for an area, worked out
+// from the history over a number of weeks. Each of the grids is
+// indexed by day of the week (Sunday is 0, as in time.Weekday) and
+// then hour of the day, in the time zone the profile was made in
+type Profile struct {
+	Area  string
+	From  time.Time
+	To    time.Time
+	Weeks int
+	// The average fraction (0 to 1) of each hour that the area was
+	// occupied
+	Occupancy [7][24]float64
+	// The average number of activations during each hour
+	Activations [7][24]float64
+}
+
+// Slot is a single hour in a Profile
+type Slot struct {
+	Day       time.Weekday
+	Hour      int
+	Occupancy float64
+}
+
+// String gives the slot as e.g. "Tue 7pm"
+func (s Slot) String() string {
+	hour := s.Hour % 12
+	if hour == 0 {
+		hour = 12
+	}
+	ampm := "am"
+	if s.Hour >= 12 {
+		ampm = "pm"
+	}
+	return fmt.Sprintf("%s %d%s", s.Day.String()[:3], hour, ampm)
+}
+
+// Percent is the occupancy as a whole percentage
+func (s Slot) Percent() int {
+	return int(s.Occupancy*100 + 0.5)
+}
+
+// WeeklyProfile works out the profile of the area over the given
+// number of weeks up to the start of the current hour, in loc
+func (h *DB) WeeklyProfile(area string, weeks int, loc *time.Location) (*Profile, error) {
+	if weeks < 1 {
+		return nil, errors.New("the profile has to cover at least a week")
+	}
+
+	now := time.Now().In(loc)
+	to := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, loc)
+	from := to.AddDate(0, 0, -7*weeks)
+
+	buckets, err := h.Buckets(Query{
+		Area:   area,
+		From:   from,
+		To:     to,
+		Bucket: time.Hour,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Profile{Area: area, From: from, To: to, Weeks: weeks}
+
+	// Every hour of the week shows up once a week, give or take
+	// daylight saving time, so we count them rather than assume
+	var samples [7][24]int
+	for _, b := range buckets {
+		start := b.Start.In(loc)
+		day, hour := start.Weekday(), start.Hour()
+		p.Occupancy[day][hour] += float64(b.OccupiedSeconds) / time.Hour.Seconds()
+		p.Activations[day][hour] += float64(b.Activations)
+		samples[day][hour]++
+	}
+	for day := range samples {
+		for hour, n := range samples[day] {
+			if n > 0 {
+				p.Occupancy[day][hour] /= float64(n)
+				p.Activations[day][hour] /= float64(n)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// slots returns every hour of the week, busiest first
+func (p *Profile) slots() []Slot {
+	slots := make([]Slot, 0, 7*24)
+	for day := range p.Occupancy {
+		for hour, occupancy := range p.Occupancy[day] {
+			slots = append(slots, Slot{Day: time.Weekday(day), Hour: hour, Occupancy: occupancy})
+		}
+	}
+	sort.SliceStable(slots, func(i, j int) bool {
+		return slots[i].Occupancy > slots[j].Occupancy
+	})
+	return slots
+}
+
+// Busiest returns up to n of the hours the area is usually busiest,
+// busiest first. Hours no one has ever been in aren't included
+func (p *Profile) Busiest(n int) []Slot {
+	var busiest []Slot
+	for _, s := range p.slots() {
+		if len(busiest) == n || s.Occupancy == 0 {
+			break
+		}
+		busiest = append(busiest, s)
+	}
+	return busiest
+}
+
+// Quietest returns up to n of the hours the area is usually quietest,
+// quietest first. Hours no one has ever been in (which is most of the
+// middle of the night) aren't included, as what people want to know is
+// when the area is quiet while people are around
+func (p *Profile) Quietest(n int) []Slot {
+	slots := p.slots()
+	var quietest []Slot
+	for i := len(slots) - 1; i >= 0 && len(quietest) < n; i-- {
+		if slots[i].Occupancy > 0 {
+			quietest = append(quietest, slots[i])
+		}
+	}
+	return quietest
+}
@@ -0,0 +1,298 @@
+package history
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The most buckets we'll work out in one go, so that someone asking
+// for a year in one-minute buckets doesn't take the program down
+const maxBuckets = 10000
+
+// Query is what we want to know about. Either or both of Area and
+// Sensor can be left empty to include everything. The time from From
+// up to (but not including) To is split into buckets of Bucket, the
+// first of which starts at From
+type Query struct {
+	Area   string
+	Sensor string
+	From   time.Time
+	To     time.Time
+	Bucket time.Duration
+}
+
+// Bucket is how much was going on during one slice of a Query. The
+// occupied time is how long any of the sensors in the query were on,
+// so two sensors in the same area being on at once doesn't count twice
+type Bucket struct {
+	Start           time.Time `json:"start"`
+	OccupiedSeconds int64     `json:"occupied_seconds"`
+	Activations     int       `json:"activations"`
+}
+
+// span is a stretch of time, in unix seconds, from start up to end
+type span struct {
+	start int64
+	end   int64
+}
+
+// Check makes sure the query makes sense, so that a bad query can be
+// told apart from something going wrong with the database
+func (q Query) Check() error {
+	if !q.To.After(q.From) {
+		return errors.New("the end of the query has to be after the start")
+	}
+	if q.Bucket < time.Second {
+		return errors.New("buckets have to be at least a second long")
+	}
+	// Everything is in whole seconds, so the buckets have to be too
+	if q.Bucket%time.Second != 0 {
+		return errors.New("buckets have to be a whole number of seconds")
+	}
+	if count := q.count(); count > maxBuckets {
+		return fmt.Errorf("that's %d buckets, and the most we'll do is %d", count, maxBuckets)
+	}
+	return nil
+}
+
+// count is how many buckets the query has, the last of which can be
+// cut short by the end of the query
+func (q Query) count() int {
+	size := int64(q.Bucket / time.Second)
+	return int((q.To.Unix() - q.From.Unix() + size - 1) / size)
+}
+
+// Buckets works out the occupied time and number of activations
+// in each bucket of the query
+func (h *DB) Buckets(q Query) ([]Bucket, error) {
+	if err := q.Check(); err != nil {
+		return nil, err
+	}
+
+	from := q.From.Unix()
+	to := q.To.Unix()
+	size := int64(q.Bucket / time.Second)
+	count := q.count()
+
+	buckets := make([]Bucket, count)
+	for i := range buckets {
+		buckets[i].Start = time.Unix(from+int64(i)*size, 0)
+	}
+
+	// The activations are easy, they just go in whichever bucket
+	// they happened in
+	where, args := q.filter()
+	rows, err := h.db.Query(`SELECT ts FROM activations WHERE ts >= ? AND ts < ?`+where,
+		append([]interface{}{from, to}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("could not look up activations: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ts int64
+		if err := rows.Scan(&ts); err != nil {
+			return nil, err
+		}
+		buckets[(ts-from)/size].Activations++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The intervals can start before the query, run past the end of it,
+	// and overlap each other, so we merge them first and then add up
+	// how much of each bucket they cover
+	spans, err := h.spans(q, from, to)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range spans {
+		for i := (s.start - from) / size; i < int64(count); i++ {
+			bucketStart := from + i*size
+			bucketEnd := bucketStart + size
+			if bucketEnd > to {
+				bucketEnd = to
+			}
+			if s.end <= bucketStart {
+				break
+			}
+			buckets[i].OccupiedSeconds += min64(s.end, bucketEnd) - max64(s.start, bucketStart)
+		}
+	}
+
+	return buckets, nil
+}
+
+// interval is a stretch of time that a sensor was on
+type interval struct {
+	sensor string
+	area   string
+	span
+}
+
+// intervals finds every interval that overlaps the query, clipped to
+// the query. An interval that hasn't ended yet is taken as going on
+// until now
+func (h *DB) intervals(q Query, from, to int64) ([]interval, error) {
+	now := time.Now().Unix()
+	where, args := q.filter()
+	rows, err := h.db.Query(`SELECT sensor, area, start, COALESCE(end, MAX(last_seen, ?)) AS stop FROM intervals
+		WHERE start < ? AND COALESCE(end, MAX(last_seen, ?)) > ?`+where,
+		append([]interface{}{now, to, now, from}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("could not look up intervals: %v", err)
+	}
+	defer rows.Close()
+
+	var intervals []interval
+	for rows.Next() {
+		var i interval
+		if err := rows.Scan(&i.sensor, &i.area, &i.start, &i.end); err != nil {
+			return nil, err
+		}
+		i.start = max64(i.start, from)
+		i.end = min64(i.end, to)
+		if i.end > i.start {
+			intervals = append(intervals, i)
+		}
+	}
+
+	return intervals, rows.Err()
+}
+
+// spans finds every interval that overlaps the query, clipped to the
+// query and merged together where they overlap
+func (h *DB) spans(q Query, from, to int64) ([]span, error) {
+	intervals, err := h.intervals(q, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	spans := make([]span, 0, len(intervals))
+	for _, i := range intervals {
+		spans = append(spans, i.span)
+	}
+
+	return mergeSpans(spans), nil
+}
+
+// mergeSpans sorts the spans and joins together any that overlap
+func mergeSpans(spans []span) []span {
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start
+	})
+
+	var merged []span
+	for _, s := range spans {
+		last := len(merged) - 1
+		if last >= 0 && s.start <= merged[last].end {
+			merged[last].end = max64(merged[last].end, s.end)
+			continue
+		}
+		merged = append(merged, s)
+	}
+
+	return merged
+}
+
+// Total is how much a single sensor was used over a stretch of time
+type Total struct {
+	Sensor          string `json:"sensor"`
+	Area            string `json:"area"`
+	OccupiedSeconds int64  `json:"occupied_seconds"`
+	Activations     int    `json:"activations"`
+}
+
+// Totals works out how long each sensor was on, and how many times
+// it was triggered, from from up to to. Only sensors that were on or
+// triggered in that time are included, sorted by name
+func (h *DB) Totals(from, to time.Time) ([]Total, error) {
+	if !to.After(from) {
+		return nil, errors.New("the end has to be after the start")
+	}
+
+	totals := make(map[string]*Total)
+	total := func(sensor, area string) *Total {
+		t, ok := totals[sensor]
+		if !ok {
+			t = &Total{Sensor: sensor, Area: area}
+			totals[sensor] = t
+		}
+		return t
+	}
+
+	rows, err := h.db.Query(`SELECT sensor, area, COUNT(*) FROM activations WHERE ts >= ? AND ts < ? GROUP BY sensor, area`,
+		from.Unix(), to.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("could not look up activations: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sensor, area string
+		var count int
+		if err := rows.Scan(&sensor, &area, &count); err != nil {
+			return nil, err
+		}
+		total(sensor, area).Activations += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	intervals, err := h.intervals(Query{}, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	bySensor := make(map[string][]span)
+	for _, i := range intervals {
+		total(i.sensor, i.area)
+		bySensor[i.sensor] = append(bySensor[i.sensor], i.span)
+	}
+	for sensor, spans := range bySensor {
+		for _, s := range mergeSpans(spans) {
+			totals[sensor].OccupiedSeconds += s.end - s.start
+		}
+	}
+
+	sorted := make([]Total, 0, len(totals))
+	for _, t := range totals {
+		sorted = append(sorted, *t)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Sensor < sorted[j].Sensor
+	})
+
+	return sorted, nil
+}
+
+// filter is the extra bit of WHERE clause for the area and sensor
+// in the query, if they were given
+func (q Query) filter() (string, []interface{}) {
+	where := ""
+	var args []interface{}
+	if len(q.Area) > 0 {
+		where += " AND area = ?"
+		args = append(args, q.Area)
+	}
+	if len(q.Sensor) > 0 {
+		where += " AND sensor = ?"
+		args = append(args, q.Sensor)
+	}
+	return where, args
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,328 @@
+// Package message defines the payload that the shopmon programs pass
+// to each other over MQTT.
+//
+// Historically everything was sent as a comma-separated line, either
+// the raw line from the sensors program on shopmontopic, e.g.
+//
+//	1597446363,Lasers-1,CNC Lounge
+//
+// or the line sensorstatus puts on webshopmontopic, which has the area
+// tacked onto the sensor name with a colon and the state on the end, e.g.
+//
+//	1597446363,Lasers-1:CNC Lounge,1
+//
+// That falls apart as soon as an area name has a comma or a colon in
+// it, so now we send a versioned JSON object instead. Parse() still
+// understands both of the old forms so that everything keeps working
+// while the programs are upgraded one at a time.
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is the version of the JSON payload that this package produces
+const Version = 1
+
+// The state of a sensor; these are the same values that were on the
+// end of the legacy status line
+const (
+	StateOff = 0
+	StateOn  = 1
+)
+
+// Where a message came from
+const (
+	SourceSensors      = "sensors"
+	SourceSensorStatus = "sensorstatus"
+)
+
+// The kinds of sensor there are. The kind of each sensor is in
+// sensors.json, and decides how it's shown and talked about, e.g.
+// a door that's on is open rather than having someone in it
+const (
+	// A motion sensor that sees someone in an area
+	KindPIR = "pir"
+	// A contact on a door, which is on while the door is open
+	KindDoor = "door"
+	// A contact on a window, which is on while the window is open
+	KindWindow = "window"
+	// The alarm panel itself
+	KindPanel = "panel"
+	// A tamper switch on a sensor or the panel
+	KindTamper = "tamper"
+)
+
+// Kinds is every kind of sensor, for checking sensors.json
+var Kinds = []string{KindPIR, KindDoor, KindWindow, KindPanel, KindTamper}
+
+// IsKnownKind reports whether the kind is one we know how to deal with
+func IsKnownKind(kind string) bool {
+	for _, k := range Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// IsOpening reports whether the kind of sensor is on something that
+// opens (a door or window), rather than seeing people
+func IsOpening(kind string) bool {
+	return kind == KindDoor || kind == KindWindow
+}
+
+// Event is a single report about a sensor
+type Event struct {
+	// The version of the payload, so we can change things later
+	Version int `json:"v"`
+	// The unix timestamp of when the sensor was last triggered
+	Timestamp int64 `json:"ts"`
+	// The name of the sensor (e.g. "Lasers-1")
+	Sensor string `json:"sensor"`
+	// The area the sensor is in (e.g. "CNC Lounge")
+	Area string `json:"area"`
+	// The zone on the alarm panel, if we know it
+	Zone string `json:"zone,omitempty"`
+	// The kind of sensor (e.g. "pir" or "door"), if we know it
+	Kind string `json:"kind,omitempty"`
+	// StateOn if someone is there, StateOff if not
+	State int `json:"state"`
+	// Which program sent the message
+	Source string `json:"source,omitempty"`
+}
+
+// Time returns the timestamp as a time.Time
+func (e Event) Time() time.Time {
+	return time.Unix(e.Timestamp, 0)
+}
+
+// On reports whether the sensor says someone is there
+func (e Event) On() bool {
+	return e.State == StateOn
+}
+
+// Marshal builds the JSON payload for the event, filling in the
+// version if it hasn't been set
+func (e Event) Marshal() ([]byte, error) {
+	if e.Version == 0 {
+		e.Version = Version
+	}
+	return json.Marshal(e)
+}
+
+// Legacy builds the old comma-separated status line that sensorstatus
+// has always put on webshopmontopic, for anything that hasn't been
+// moved over to JSON yet
+func (e Event) Legacy() string {
+	return strconv.FormatInt(e.Timestamp, 10) + "," + e.Sensor + ":" + e.Area + "," + strconv.Itoa(e.State)
+}
+
+// Parse takes a payload off a topic and turns it into an Event. JSON
+// payloads are used as-is; anything else is treated as one of the
+// legacy comma-separated lines described at the top of this file.
+func Parse(payload []byte) (Event, error) {
+	trimmed := strings.TrimSpace(string(payload))
+	if len(trimmed) == 0 {
+		return Event{}, errors.New("empty message")
+	}
+
+	if trimmed[0] == '{' {
+		var e Event
+		if err := json.Unmarshal([]byte(trimmed), &e); err != nil {
+			return Event{}, fmt.Errorf("bad JSON message %q: %v", trimmed, err)
+		}
+		if e.Version > Version {
+			return Event{}, fmt.Errorf("unsupported message version %d", e.Version)
+		}
+		if len(e.Sensor) == 0 {
+			return Event{}, fmt.Errorf("no sensor in message %q", trimmed)
+		}
+		return e, nil
+	}
+
+	return parseLegacy(trimmed)
+}
+
+// parseLegacy handles the two comma-separated forms. The first field
+// is always the timestamp, and the last field is either the state (a
+// status line from sensorstatus) or the area (a raw line from sensors)
+func parseLegacy(line string) (Event, error) {
+	firstComma := strings.Index(line, ",")
+	lastComma := strings.LastIndex(line, ",")
+	if firstComma < 0 || firstComma == lastComma {
+		return Event{}, fmt.Errorf("malformed message %q", line)
+	}
+
+	ts, err := strconv.ParseInt(line[:firstComma], 10, 64)
+	if err != nil {
+		return Event{}, fmt.Errorf("bad timestamp in message %q: %v", line, err)
+	}
+
+	middle := line[firstComma+1 : lastComma]
+	last := line[lastComma+1:]
+
+	e := Event{Version: Version, Timestamp: ts}
+	if last == "0" || last == "1" {
+		// A status line, so the middle is sensor:area
+		e.State, _ = strconv.Atoi(last)
+		e.Source = SourceSensorStatus
+		e.Sensor = middle
+		if nameParts := strings.SplitN(middle, ":", 2); len(nameParts) == 2 {
+			e.Sensor = nameParts[0]
+			e.Area = nameParts[1]
+		}
+	} else {
+		// A raw line from the sensors program, which is always
+		// an activation. The sensor names never have commas in
+		// them, so anything after the first one is the area
+		e.State = StateOn
+		e.Source = SourceSensors
+		rest := line[firstComma+1:]
+		sensorEnd := strings.Index(rest, ",")
+		e.Sensor = rest[:sensorEnd]
+		e.Area = rest[sensorEnd+1:]
+	}
+
+	if len(e.Sensor) == 0 {
+		return Event{}, fmt.Errorf("no sensor in message %q", line)
+	}
+
+	return e, nil
+}
+
+// AreaEvent is a report about a whole area, which is occupied as long
+// as any of the sensors in it are on
+type AreaEvent struct {
+	// The version of the payload, so we can change things later
+	Version int `json:"v"`
+	// The unix timestamp of when a sensor in the area was last triggered
+	Timestamp int64 `json:"ts"`
+	// The name of the area (e.g. "Woodshop")
+	Area string `json:"area"`
+	// StateOn if someone is there, StateOff if not
+	State int `json:"state"`
+	// The sensors in the area that are on
+	Sensors []string `json:"sensors,omitempty"`
+	// Which program sent the message
+	Source string `json:"source,omitempty"`
+}
+
+// Time returns the timestamp as a time.Time
+func (e AreaEvent) Time() time.Time {
+	return time.Unix(e.Timestamp, 0)
+}
+
+// On reports whether someone is in the area
+func (e AreaEvent) On() bool {
+	return e.State == StateOn
+}
+
+// Marshal builds the JSON payload for the event, filling in the
+// version if it hasn't been set
+func (e AreaEvent) Marshal() ([]byte, error) {
+	if e.Version == 0 {
+		e.Version = Version
+	}
+	return json.Marshal(e)
+}
+
+// ParseArea takes a payload off an area topic and turns it into
+// an AreaEvent. There's no legacy form of these, so it's JSON only
+func ParseArea(payload []byte) (AreaEvent, error) {
+	var e AreaEvent
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return AreaEvent{}, fmt.Errorf("bad area message %q: %v", payload, err)
+	}
+	if e.Version > Version {
+		return AreaEvent{}, fmt.Errorf("unsupported message version %d", e.Version)
+	}
+	if len(e.Area) == 0 {
+		return AreaEvent{}, fmt.Errorf("no area in message %q", payload)
+	}
+	return e, nil
+}
+
+// DoorEvent is the state of a door (or window), which is open for as
+// long as the panel keeps reporting it as faulted. sensorstatus sends
+// one when a door opens and when it closes
+type DoorEvent struct {
+	// The version of the payload, so we can change things later
+	Version int `json:"v"`
+	// The unix timestamp of when the door opened or closed
+	Timestamp int64 `json:"ts"`
+	// The name of the door's sensor (e.g. "Dock-Door")
+	Door string `json:"door"`
+	// The area the door is in
+	Area string `json:"area"`
+	// StateOn if the door is open, StateOff if it's closed
+	State int `json:"state"`
+	// The unix timestamp of when the door was opened
+	OpenedAt int64 `json:"opened_at"`
+	// How many seconds the door was open for, once it's closed
+	Duration int64 `json:"duration,omitempty"`
+	// Which program sent the message
+	Source string `json:"source,omitempty"`
+}
+
+// Time returns the timestamp as a time.Time
+func (e DoorEvent) Time() time.Time {
+	return time.Unix(e.Timestamp, 0)
+}
+
+// Open reports whether the door is open
+func (e DoorEvent) Open() bool {
+	return e.State == StateOn
+}
+
+// OpenFor is how long the door has been open, if it's open, or how
+// long it was open for if it's closed
+func (e DoorEvent) OpenFor(now time.Time) time.Duration {
+	if !e.Open() {
+		return time.Duration(e.Duration) * time.Second
+	}
+	return now.Sub(time.Unix(e.OpenedAt, 0))
+}
+
+// Marshal builds the JSON payload for the event, filling in the
+// version if it hasn't been set
+func (e DoorEvent) Marshal() ([]byte, error) {
+	if e.Version == 0 {
+		e.Version = Version
+	}
+	return json.Marshal(e)
+}
+
+// ParseDoor takes a payload off a door topic and turns it into a
+// DoorEvent. Like the area messages, these are JSON only
+func ParseDoor(payload []byte) (DoorEvent, error) {
+	var e DoorEvent
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return DoorEvent{}, fmt.Errorf("bad door message %q: %v", payload, err)
+	}
+	if e.Version > Version {
+		return DoorEvent{}, fmt.Errorf("unsupported message version %d", e.Version)
+	}
+	if len(e.Door) == 0 {
+		return DoorEvent{}, fmt.Errorf("no door in message %q", payload)
+	}
+	return e, nil
+}
+
+// TopicName makes a sensor or area name safe to use as one level of
+// an MQTT topic (e.g. "shopmon/area/Lounge 2.0"). The wildcards and
+// the level separator aren't allowed, so they're replaced with "_"
+func TopicName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '+', '#', 0:
+			return '_'
+		}
+		return r
+	}, name)
+}
@@ -0,0 +1,104 @@
+package message
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    Event
+		wantErr bool
+	}{
+		{
+			name:    "json",
+			payload: `{"v":1,"ts":1597446363,"sensor":"Lasers-1","area":"CNC Lounge","zone":"12","kind":"pir","state":1,"source":"sensorstatus"}`,
+			want:    Event{Version: 1, Timestamp: 1597446363, Sensor: "Lasers-1", Area: "CNC Lounge", Zone: "12", Kind: "pir", State: StateOn, Source: SourceSensorStatus},
+		},
+		{
+			name:    "json with commas and colons in the area",
+			payload: `{"v":1,"ts":1597446363,"sensor":"Lasers-1","area":"Lounge: CNC, Lasers","state":0}`,
+			want:    Event{Version: 1, Timestamp: 1597446363, Sensor: "Lasers-1", Area: "Lounge: CNC, Lasers", State: StateOff},
+		},
+		{
+			name:    "json without a version",
+			payload: `{"ts":1597446363,"sensor":"Lasers-1","area":"CNC Lounge","state":1}`,
+			want:    Event{Timestamp: 1597446363, Sensor: "Lasers-1", Area: "CNC Lounge", State: StateOn},
+		},
+		{
+			name:    "json with spaces around it",
+			payload: "  {\"v\":1,\"ts\":1,\"sensor\":\"Lasers-1\",\"state\":1}\n",
+			want:    Event{Version: 1, Timestamp: 1, Sensor: "Lasers-1", State: StateOn},
+		},
+		{
+			name:    "legacy status line",
+			payload: "1597446363,Lasers-1:CNC Lounge,1",
+			want:    Event{Version: Version, Timestamp: 1597446363, Sensor: "Lasers-1", Area: "CNC Lounge", State: StateOn, Source: SourceSensorStatus},
+		},
+		{
+			name:    "legacy status line that's off",
+			payload: "1597446363,Lasers-1:CNC Lounge,0",
+			want:    Event{Version: Version, Timestamp: 1597446363, Sensor: "Lasers-1", Area: "CNC Lounge", State: StateOff, Source: SourceSensorStatus},
+		},
+		{
+			name:    "legacy status line without an area",
+			payload: "1597446363,Lasers-1,1",
+			want:    Event{Version: Version, Timestamp: 1597446363, Sensor: "Lasers-1", State: StateOn, Source: SourceSensorStatus},
+		},
+		{
+			name:    "legacy sensors line",
+			payload: "1597446363,Lasers-1,CNC Lounge",
+			want:    Event{Version: Version, Timestamp: 1597446363, Sensor: "Lasers-1", Area: "CNC Lounge", State: StateOn, Source: SourceSensors},
+		},
+		{
+			name:    "legacy sensors line with a comma in the area",
+			payload: "1597446363,Lasers-1,CNC Lounge, Lasers",
+			want:    Event{Version: Version, Timestamp: 1597446363, Sensor: "Lasers-1", Area: "CNC Lounge, Lasers", State: StateOn, Source: SourceSensors},
+		},
+		{name: "empty", payload: "", wantErr: true},
+		{name: "just spaces", payload: "   ", wantErr: true},
+		{name: "bad json", payload: `{"v":1,"ts":`, wantErr: true},
+		{name: "json with the wrong types", payload: `{"v":1,"ts":"yesterday","sensor":"Lasers-1"}`, wantErr: true},
+		{name: "json without a sensor", payload: `{"v":1,"ts":1597446363,"area":"CNC Lounge","state":1}`, wantErr: true},
+		{name: "newer version", payload: `{"v":2,"ts":1597446363,"sensor":"Lasers-1","state":1}`, wantErr: true},
+		{name: "no commas", payload: "1597446363", wantErr: true},
+		{name: "one comma", payload: "1597446363,Lasers-1", wantErr: true},
+		{name: "bad timestamp", payload: "yesterday,Lasers-1:CNC Lounge,1", wantErr: true},
+		{name: "legacy without a sensor", payload: "1597446363,:CNC Lounge,1", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Parse([]byte(test.payload))
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("Parse(%q) = %+v, want an error", test.payload, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", test.payload, err)
+			}
+			if got != test.want {
+				t.Errorf("Parse(%q) = %+v, want %+v", test.payload, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRoundTrip(t *testing.T) {
+	e := Event{Version: Version, Timestamp: 1597446363, Sensor: "Lasers-1", Area: "CNC Lounge", State: StateOn, Source: SourceSensorStatus}
+
+	payload, err := e.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Parse(payload); err != nil || got != e {
+		t.Errorf("Parse(Marshal()) = %+v, %v, want %+v", got, err, e)
+	}
+
+	if got, err := Parse([]byte(e.Legacy())); err != nil || got != e {
+		t.Errorf("Parse(Legacy()) = %+v, %v, want %+v", got, err, e)
+	}
+}
@@ -0,0 +1,260 @@
+// Package mqttclient wraps the paho MQTT client with the bits that
+// every shopmon program needs: a configurable broker, optional TLS
+// and username/password, reconnecting (and resubscribing) when the
+// connection to the broker drops, and shutting down when a context
+// is cancelled.
+package mqttclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// How long we'll wait for the broker to acknowledge things
+// before giving up on them
+const (
+	subscribeTimeout  = 10 * time.Second
+	publishTimeout    = 5 * time.Second
+	disconnectQuiesce = 250 // milliseconds
+)
+
+// How long to wait between attempts to connect to the broker
+const retryInterval = 10 * time.Second
+
+// Options describes how to connect to the broker. The tags are for
+// the shared config package, so the options can be a section in a
+// program's config file
+type Options struct {
+	// The URL to the MQTT server in the format of
+	// "tcp://yourservername:port" (port is typically 1883), or
+	// "ssl://yourservername:port" for TLS (port is typically 8883)
+	Broker string `help:"MQTT server URL (e.g. tcp://host:1883)"`
+	// The clientID must be a unique name for connecting to the
+	// broker, otherwise you may get disconnect errors
+	ClientID string `help:"unique MQTT client ID"`
+	// Optional credentials for the broker
+	Username string `help:"MQTT username"`
+	Password string `help:"MQTT password" secret:"true"`
+	// The QoS to subscribe and publish with
+	QoS int `help:"MQTT QoS (0, 1 or 2)"`
+	// Optional TLS settings. CAFile is used to verify the broker,
+	// and CertFile/KeyFile are for a client certificate if the
+	// broker wants one
+	CAFile             string `help:"CA certificate to verify the MQTT server with"`
+	CertFile           string `help:"client certificate for the MQTT server"`
+	KeyFile            string `help:"client certificate key for the MQTT server"`
+	InsecureSkipVerify bool   `help:"don't verify the MQTT server's certificate"`
+}
+
+// Validate checks that the options make sense
+func (opts *Options) Validate() error {
+	if len(opts.Broker) == 0 {
+		return errors.New("no MQTT broker given")
+	}
+	u, err := url.Parse(opts.Broker)
+	if err != nil {
+		return fmt.Errorf("bad MQTT broker %q: %v", opts.Broker, err)
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "tcps", "mqtts", "mqtt+ssl", "ws", "wss", "unix":
+	default:
+		return fmt.Errorf("bad MQTT broker %q: unknown scheme %q", opts.Broker, u.Scheme)
+	}
+	if len(opts.ClientID) == 0 {
+		return errors.New("no MQTT client ID given")
+	}
+	if opts.QoS < 0 || opts.QoS > 2 {
+		return fmt.Errorf("MQTT QoS must be 0, 1 or 2, not %d", opts.QoS)
+	}
+	if (len(opts.CertFile) > 0) != (len(opts.KeyFile) > 0) {
+		return errors.New("MQTT CertFile and KeyFile have to be given together")
+	}
+	return nil
+}
+
+// Handler is called with every message received on a topic
+type Handler func(topic string, payload []byte)
+
+// Client is a connection to the broker that remembers what it's
+// subscribed to, so that it can subscribe again after a reconnect
+type Client struct {
+	opts   Options
+	client MQTT.Client
+
+	mutex         sync.Mutex
+	subscriptions map[string]Handler
+}
+
+// New sets up a client with the given options, but doesn't
+// connect it; call Connect() once the subscriptions are set up
+func New(opts Options) (*Client, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		opts:          opts,
+		subscriptions: make(map[string]Handler),
+	}
+
+	connOpts := MQTT.NewClientOptions().
+		AddBroker(opts.Broker).
+		SetClientID(opts.ClientID).
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(retryInterval)
+
+	if len(opts.Username) > 0 {
+		connOpts.SetUsername(opts.Username)
+		connOpts.SetPassword(opts.Password)
+	}
+
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		connOpts.SetTLSConfig(tlsConfig)
+	}
+
+	connOpts.SetOnConnectHandler(c.onConnect)
+	connOpts.SetConnectionLostHandler(func(_ MQTT.Client, err error) {
+		log.Printf("Lost connection to %s: %v\n", opts.Broker, err)
+	})
+	connOpts.SetReconnectingHandler(func(_ MQTT.Client, _ *MQTT.ClientOptions) {
+		log.Printf("Reconnecting to %s\n", opts.Broker)
+	})
+
+	c.client = MQTT.NewClient(connOpts)
+
+	return c, nil
+}
+
+// tlsConfig builds the TLS configuration from the options, or
+// returns nil if none of the TLS options were set
+func (opts Options) tlsConfig() (*tls.Config, error) {
+	if len(opts.CAFile) == 0 && len(opts.CertFile) == 0 && !opts.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}
+
+	if len(opts.CAFile) > 0 {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read MQTT CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(opts.CertFile) > 0 || len(opts.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load MQTT client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// onConnect is called by paho every time we (re)connect. We use a
+// clean session, so the broker forgets our subscriptions whenever
+// we drop off, which is why we subscribe to everything again here
+func (c *Client) onConnect(client MQTT.Client) {
+	log.Printf("Connected to %s\n", c.opts.Broker)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for topic, handler := range c.subscriptions {
+		if err := c.subscribe(topic, handler); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// subscribe asks the broker for the topic and waits for it to say
+// okay
+func (c *Client) subscribe(topic string, handler Handler) error {
+	token := c.client.Subscribe(topic, byte(c.opts.QoS), func(_ MQTT.Client, message MQTT.Message) {
+		handler(message.Topic(), message.Payload())
+	})
+	if !token.WaitTimeout(subscribeTimeout) {
+		return fmt.Errorf("timed out subscribing to %s", topic)
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("could not subscribe to %s: %v", topic, err)
+	}
+	log.Printf("Subscribed to %s\n", topic)
+	return nil
+}
+
+// Subscribe calls the handler for every message on the topic. The
+// topic can have the usual MQTT wildcards in it (e.g. "shopmon/#").
+// If we're already connected we subscribe right away, otherwise it
+// happens when we connect.
+func (c *Client) Subscribe(topic string, handler Handler) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.subscriptions[topic] = handler
+	if c.client.IsConnectionOpen() {
+		return c.subscribe(topic, handler)
+	}
+	return nil
+}
+
+// Connect connects to the broker, waiting until either we're connected
+// or the context is cancelled. If the broker isn't there we keep trying
+// every so often. Once connected, we stay connected (reconnecting as
+// necessary) until the context is cancelled, at which point we
+// disconnect from the broker.
+func (c *Client) Connect(ctx context.Context) error {
+	token := c.client.Connect()
+
+	select {
+	case <-token.Done():
+		if err := token.Error(); err != nil {
+			return fmt.Errorf("could not connect to %s: %v", c.opts.Broker, err)
+		}
+	case <-ctx.Done():
+		c.client.Disconnect(disconnectQuiesce)
+		return ctx.Err()
+	}
+
+	go func() {
+		<-ctx.Done()
+		log.Printf("Disconnecting from %s\n", c.opts.Broker)
+		c.client.Disconnect(disconnectQuiesce)
+	}()
+
+	return nil
+}
+
+// Publish sends the payload to the topic. Retained messages are kept
+// by the broker and handed to anyone who subscribes later.
+func (c *Client) Publish(topic string, payload []byte, retained bool) error {
+	token := c.client.Publish(topic, byte(c.opts.QoS), retained, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("timed out publishing to %s", topic)
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("could not publish to %s: %v", topic, err)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+// Package registry loads sensors.json, the list of every sensor we
+// have, which area it's in, which zone on the alarm panel it's wired
+// to, where it is and what kind of sensor it is. The sensors program
+// uses the same file to turn zones into sensor names, so adding a
+// sensor to that one file is enough for everything to know about it.
+//
+// The file is checked every so often and reloaded if it changes, so
+// the programs don't have to be restarted when a sensor is added.
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pumpingstationone/shopmon/shared/message"
+)
+
+// How often we check to see if the file has changed
+const checkInterval = 10 * time.Second
+
+// Sensor is a single entry in sensors.json
+type Sensor struct {
+	Name     string `json:"name"`
+	Area     string `json:"area"`
+	Zone     string `json:"zone"`
+	Location string `json:"location"`
+	// What kind of sensor it is (see the Kind constants in the
+	// message package); a PIR sensor if the file doesn't say
+	Kind string `json:"kind"`
+}
+
+// Registry is the set of sensors from the file
+type Registry struct {
+	path string
+
+	mutex   sync.RWMutex
+	sensors []Sensor
+	byName  map[string]Sensor
+	byZone  map[string]Sensor
+	modTime time.Time
+}
+
+// New sets up a registry for the file at path. It's empty until
+// Reload() is called
+func New(path string) *Registry {
+	return &Registry{
+		path:   path,
+		byName: make(map[string]Sensor),
+		byZone: make(map[string]Sensor),
+	}
+}
+
+// Path returns the file the registry is loaded from
+func (r *Registry) Path() string {
+	return r.path
+}
+
+// Reload reads the file again. If there's anything wrong with it we
+// keep what we had before
+func (r *Registry) Reload() error {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+
+	var sensors []Sensor
+	if err := json.Unmarshal(data, &sensors); err != nil {
+		return fmt.Errorf("bad sensor file %s: %v", r.path, err)
+	}
+
+	byName := make(map[string]Sensor)
+	byZone := make(map[string]Sensor)
+	for i, s := range sensors {
+		if len(s.Name) == 0 {
+			return fmt.Errorf("bad sensor file %s: sensor in zone %s has no name", r.path, s.Zone)
+		}
+		if _, exists := byName[s.Name]; exists {
+			return fmt.Errorf("bad sensor file %s: %s is in there twice", r.path, s.Name)
+		}
+		if len(s.Kind) == 0 {
+			s.Kind = message.KindPIR
+			sensors[i] = s
+		}
+		if !message.IsKnownKind(s.Kind) {
+			return fmt.Errorf("bad sensor file %s: %s is a %q, which should be one of %s",
+				r.path, s.Name, s.Kind, strings.Join(message.Kinds, ", "))
+		}
+		byName[s.Name] = s
+		if len(s.Zone) > 0 {
+			byZone[s.Zone] = s
+		}
+	}
+
+	sort.Slice(sensors, func(i, j int) bool {
+		return sensors[i].Name < sensors[j].Name
+	})
+
+	r.mutex.Lock()
+	r.sensors = sensors
+	r.byName = byName
+	r.byZone = byZone
+	r.modTime = info.ModTime()
+	r.mutex.Unlock()
+
+	log.Printf("Loaded %d sensors from %s\n", len(sensors), r.path)
+
+	return nil
+}
+
+// Watch checks the file every so often and reloads it if it has
+// changed, until the context is cancelled
+func (r *Registry) Watch(ctx context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(r.path)
+			if err != nil {
+				if !errors.Is(err, os.ErrNotExist) {
+					log.Println(err)
+				}
+				continue
+			}
+
+			r.mutex.RLock()
+			changed := !info.ModTime().Equal(r.modTime)
+			r.mutex.RUnlock()
+
+			if changed {
+				if err := r.Reload(); err != nil {
+					log.Println("Could not reload sensors:", err)
+				}
+			}
+		}
+	}
+}
+
+// Lookup finds the sensor with the given name
+func (r *Registry) Lookup(name string) (Sensor, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	s, ok := r.byName[name]
+	return s, ok
+}
+
+// LookupZone finds the sensor wired to the given zone on the panel
+func (r *Registry) LookupZone(zone string) (Sensor, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	s, ok := r.byZone[zone]
+	return s, ok
+}
+
+// Sensors returns every sensor, sorted by name
+func (r *Registry) Sensors() []Sensor {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	sensors := make([]Sensor, len(r.sensors))
+	copy(sensors, r.sensors)
+	return sensors
+}
+
+// AreaKind returns the kind of sensor the area has in it, if every
+// sensor in the area is the same kind (e.g. "Dock Door" only has a
+// door in it), or a PIR sensor otherwise, since an area with anything
+// else in it is somewhere people are
+func (r *Registry) AreaKind(area string) string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	kind := ""
+	for _, s := range r.sensors {
+		if s.Area != area {
+			continue
+		}
+		if len(kind) > 0 && s.Kind != kind {
+			return message.KindPIR
+		}
+		kind = s.Kind
+	}
+	if len(kind) == 0 {
+		return message.KindPIR
+	}
+	return kind
+}
+
+// Areas returns the name of every area that has a sensor in it,
+// sorted by name
+func (r *Registry) Areas() []string {
+	r.mutex.RLock()
+	seen := make(map[string]bool)
+	var areas []string
+	for _, s := range r.sensors {
+		if len(s.Area) > 0 && !seen[s.Area] {
+			seen[s.Area] = true
+			areas = append(areas, s.Area)
+		}
+	}
+	r.mutex.RUnlock()
+
+	sort.Strings(areas)
+	return areas
+}
+
+// Enrich fills in what we know about the sensor in the event. The
+// registry is the authority on which area and zone a sensor is in,
+// and what kind of sensor it is, so those are replaced if they're
+// different. It returns false if the sensor isn't in the registry, in
+// which case the event is left alone.
+func (r *Registry) Enrich(e *message.Event) bool {
+	s, ok := r.Lookup(e.Sensor)
+	if !ok && len(e.Zone) > 0 {
+		s, ok = r.LookupZone(e.Zone)
+		if ok {
+			e.Sensor = s.Name
+		}
+	}
+	if !ok {
+		return false
+	}
+
+	e.Area = s.Area
+	e.Zone = s.Zone
+	e.Kind = s.Kind
+	return true
+}
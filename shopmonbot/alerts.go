@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pumpingstationone/shopmon/shared/config"
+	"github.com/pumpingstationone/shopmon/shared/message"
+	"github.com/slack-go/slack"
+)
+
+/*
+ * A dock door left open overnight is a problem, so if a door has been open
+ * for longer than it should be, we say so in the alerts channel. If it's
+ * still open a while later we say so again (in a thread on the first alert,
+ * but shown in the channel too) and mention whoever should deal with it, and
+ * when it's finally closed we say that too, so no one goes to close a door
+ * that's already closed.
+ *
+ * How long a door can be open before we say anything, how often we nag and
+ * who we mention all come from the Alerts section of the config, and can be
+ * set per door in the doors file, e.g.
+ *
+ *	{
+ *	  "Dock-Door":  { "after": "10m", "escalate_every": "20m", "mention": "<!subteam^S0123>", "ignore_quiet_hours": true },
+ *	  "Front-Door": { "after": "5m" }
+ *	}
+ *
+ * Nothing is posted during the quiet hours (unless the door ignores them);
+ * anything that comes due then is posted when they're over, if the door is
+ * still open. We don't remember alerts across restarts, so if the bot is
+ * restarted while a door is open it'll say so again.
+ */
+
+// How often we check for doors that have been open too long
+const alertCheckEvery = 30 * time.Second
+
+// DoorRule is how we alert about a door. Anything left out gets what's
+// in the Alerts section of the config
+type DoorRule struct {
+	After            config.Duration `json:"after"`
+	EscalateEvery    config.Duration `json:"escalate_every"`
+	Mention          string          `json:"mention"`
+	IgnoreQuietHours bool            `json:"ignore_quiet_hours"`
+}
+
+// The rules for the doors in the doors file, keyed by door name
+var doorRules map[string]DoorRule
+
+// doorAlert is where we are with alerting about a door that's open
+type doorAlert struct {
+	// Which opening of the door this is about
+	openedAt int64
+	// How many times we've said something about it
+	alerts int
+	// When we last did, and the first message, which the rest go
+	// in a thread on
+	lastAlert time.Time
+	threadTS  string
+}
+
+// What we've said about each door that's open, keyed by door name.
+// Only watchDoors() uses this, so it doesn't need a mutex
+var doorAlerts = make(map[string]*doorAlert)
+
+// loadDoorRules reads the doors file. The file can be missing, in which
+// case every door gets the defaults from the config
+func loadDoorRules(doorsFile string) error {
+	rules := make(map[string]DoorRule)
+
+	if len(doorsFile) > 0 {
+		data, err := os.ReadFile(doorsFile)
+		if err == nil {
+			if err := json.Unmarshal(data, &rules); err != nil {
+				return fmt.Errorf("bad doors file %s: %v", doorsFile, err)
+			}
+			// Anything left out is 0, which gets the default
+			for door, rule := range rules {
+				for _, d := range []config.Duration{rule.After, rule.EscalateEvery} {
+					if d != 0 && time.Duration(d) < time.Minute {
+						return fmt.Errorf("bad doors file %s: %s for %s is less than a minute",
+							doorsFile, time.Duration(d), door)
+					}
+				}
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	doorRules = rules
+	return nil
+}
+
+// ruleFor returns the rule for the door, with the defaults filled in
+func ruleFor(door string) DoorRule {
+	rule := doorRules[door]
+	if rule.After == 0 {
+		rule.After = config.Duration(cfg.Alerts.After)
+	}
+	if rule.EscalateEvery == 0 {
+		rule.EscalateEvery = config.Duration(cfg.Alerts.EscalateEvery)
+	}
+	if len(rule.Mention) == 0 {
+		rule.Mention = cfg.Alerts.Mention
+	}
+	return rule
+}
+
+// quietHours is a stretch of the day, in minutes since midnight. It
+// can go past midnight (e.g. 22:00-07:00)
+type quietHours struct {
+	start int
+	end   int
+}
+
+// parseQuietHours understands e.g. "22:00-07:00". Nothing means there
+// are no quiet hours
+func parseQuietHours(s string) (*quietHours, error) {
+	if len(strings.TrimSpace(s)) == 0 {
+		return nil, nil
+	}
+
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("quiet hours %q should be like 22:00-07:00", s)
+	}
+	var minutes [2]int
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("quiet hours %q should be like 22:00-07:00", s)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+
+	return &quietHours{start: minutes[0], end: minutes[1]}, nil
+}
+
+// contains reports whether t is during the quiet hours
+func (q *quietHours) contains(t time.Time) bool {
+	if q == nil {
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if q.start <= q.end {
+		return minute >= q.start && minute < q.end
+	}
+	return minute >= q.start || minute < q.end
+}
+
+// watchDoors checks every so often for doors that have been open too
+// long (or have closed after we said something about them) until the
+// context is cancelled
+func watchDoors(ctx context.Context, api *slack.Client) {
+	quiet, _ := parseQuietHours(cfg.Alerts.QuietHours)
+
+	ticker := time.NewTicker(alertCheckEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			checkDoors(api, quiet, now)
+		}
+	}
+}
+
+// checkDoors goes through every door we've heard about and says
+// whatever needs saying
+func checkDoors(api *slack.Client, quiet *quietHours, now time.Time) {
+	doorMutex.Lock()
+	current := make(map[string]message.DoorEvent, len(doors))
+	for name, door := range doors {
+		current[name] = door
+	}
+	closed := make(map[string]message.DoorEvent, len(lastClosed))
+	for name, door := range lastClosed {
+		closed[name] = door
+	}
+	doorMutex.Unlock()
+
+	for name, door := range current {
+		rule := ruleFor(name)
+		if quiet.contains(now) && !rule.IgnoreQuietHours {
+			continue
+		}
+
+		alert, alerted := doorAlerts[name]
+
+		if !door.Open() {
+			// Whatever we said about it, it's closed now. This might
+			// not be the same opening we said something about (e.g.
+			// sensorstatus was restarted and said every door was
+			// closed), in which case we don't know how long it was
+			// open for
+			if alerted && alert.alerts > 0 {
+				text := fmt.Sprintf(":white_check_mark: The `%s` is closed now", name)
+				if alert.openedAt == door.OpenedAt {
+					text += fmt.Sprintf(", it was open for *%s*", formatTime(door.OpenFor(now)))
+				}
+				if _, err := postAlert(api, text, alert.threadTS); err != nil {
+					fmt.Println("Could not post door alert:", err)
+					continue
+				}
+			}
+			delete(doorAlerts, name)
+			continue
+		}
+
+		if alerted && alert.openedAt != door.OpenedAt {
+			// It's been closed and opened again since we last
+			// looked. Say so in the old thread first, so it doesn't
+			// look like that opening is still going, then start over
+			if alert.alerts > 0 {
+				text := fmt.Sprintf(":white_check_mark: The `%s` was closed", name)
+				if c, ok := closed[name]; ok && c.OpenedAt == alert.openedAt {
+					text += fmt.Sprintf(", it was open for *%s*", formatTime(c.OpenFor(now)))
+				}
+				text += " (it's been opened again since)"
+				if _, err := postAlert(api, text, alert.threadTS); err != nil {
+					fmt.Println("Could not post door alert:", err)
+					continue
+				}
+			}
+			delete(doorAlerts, name)
+			alerted = false
+		}
+
+		openFor := door.OpenFor(now)
+		if openFor < time.Duration(rule.After) {
+			continue
+		}
+
+		if !alerted {
+			text := fmt.Sprintf(":door: The `%s` has been open for *%s*", name, formatTime(openFor))
+			ts, err := postAlert(api, text, "")
+			if err != nil {
+				fmt.Println("Could not post door alert:", err)
+				continue
+			}
+			doorAlerts[name] = &doorAlert{openedAt: door.OpenedAt, alerts: 1, lastAlert: now, threadTS: ts}
+			continue
+		}
+
+		if now.Sub(alert.lastAlert) < time.Duration(rule.EscalateEvery) {
+			continue
+		}
+		text := fmt.Sprintf(":rotating_light: The `%s` is *still* open, it's been *%s* now", name, formatTime(openFor))
+		if len(rule.Mention) > 0 {
+			text = rule.Mention + " " + text
+		}
+		if _, err := postAlert(api, text, alert.threadTS); err != nil {
+			fmt.Println("Could not post door alert:", err)
+			continue
+		}
+		alert.alerts++
+		alert.lastAlert = now
+	}
+}
+
+// postAlert posts to the alerts channel, in the thread if we're given
+// one (and shown in the channel too), and returns the timestamp of the
+// message so later ones can go in a thread on it
+func postAlert(api *slack.Client, text, threadTS string) (string, error) {
+	options := []slack.MsgOption{slack.MsgOptionText(text, false)}
+	if len(threadTS) > 0 {
+		options = append(options, slack.MsgOptionTS(threadTS), slack.MsgOptionBroadcast())
+	}
+	_, ts, err := api.PostMessage(cfg.Alerts.Channel, options...)
+	return ts, err
+}
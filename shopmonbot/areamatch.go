@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+/*
+ * No one remembers exactly what the areas are called, so when someone asks
+ * about an area we look for it in the known areas (and their aliases) in
+ * order of how sure we can be:
+ *
+ *	1. the name or an alias, ignoring case, spaces and punctuation
+ *	   (so "coldmetals" is Cold Metals)
+ *	2. a name or alias that starts with it, or has a word that does
+ *	   ("wood" is the Woodshop, "metals" is all three metal shops)
+ *	3. a name or alias that has it somewhere in it
+ *	4. a name or alias that's only a letter or two off ("woodsop")
+ *
+ * and stop at the first of those that finds anything. If that's more than
+ * one area, we ask which one they meant. Every command that takes an area
+ * goes through resolveArea(), so they all answer the same way.
+ *
+ * The aliases are in a JSON file of alias to area, e.g.
+ *
+ *	{ "cnc": "CNC Lounge", "welding": "Hot Metals" }
+ */
+
+// Other names for areas, keyed by the alias
+var areaAliases = make(map[string]string)
+
+// loadAliases reads the aliases file. The file can be missing, in which
+// case areas just go by their names
+func loadAliases(aliasFile string) error {
+	aliases := make(map[string]string)
+
+	if len(aliasFile) > 0 {
+		data, err := os.ReadFile(aliasFile)
+		if err == nil {
+			if err := json.Unmarshal(data, &aliases); err != nil {
+				return fmt.Errorf("bad aliases file %s: %v", aliasFile, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	areaAliases = aliases
+	return nil
+}
+
+// normaliseArea lowercases the name and drops everything that isn't
+// a letter or number
+func normaliseArea(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// areaNames is every name an area goes by: its own, and its aliases
+func areaNames(area string) []string {
+	names := []string{area}
+	for alias, a := range areaAliases {
+		if strings.EqualFold(a, area) {
+			names = append(names, alias)
+		}
+	}
+	return names
+}
+
+// wordStarts reports whether any word in name starts with wanted
+func wordStarts(name, wanted string) bool {
+	for _, word := range strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if strings.HasPrefix(normaliseArea(word), wanted) {
+			return true
+		}
+	}
+	return false
+}
+
+// editDistance is how many letters have to be added, removed or
+// changed to turn a into b
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// matchAreas finds the areas that the name someone gave could be,
+// sorted by name. It's empty if nothing matches
+func matchAreas(name string) []string {
+	wanted := normaliseArea(name)
+	if len(wanted) == 0 {
+		return nil
+	}
+
+	areas := knownAreas()
+
+	// How many letters can be off, which isn't many for short names
+	// or everything would match
+	maxDistance := len(wanted) / 4
+
+	tiers := []func(name string) bool{
+		func(name string) bool {
+			return normaliseArea(name) == wanted
+		},
+		func(name string) bool {
+			return strings.HasPrefix(normaliseArea(name), wanted) || wordStarts(name, wanted)
+		},
+		func(name string) bool {
+			return strings.Contains(normaliseArea(name), wanted)
+		},
+		func(name string) bool {
+			return maxDistance > 0 && editDistance(normaliseArea(name), wanted) <= maxDistance
+		},
+	}
+
+	for _, matches := range tiers {
+		found := make(map[string]bool)
+		for _, area := range areas {
+			for _, n := range areaNames(area) {
+				if matches(n) {
+					found[area] = true
+				}
+			}
+		}
+		if len(found) > 0 {
+			var result []string
+			for area := range found {
+				result = append(result, area)
+			}
+			sort.Strings(result)
+			return result
+		}
+	}
+
+	return nil
+}
+
+// resolveArea finds the one area the name someone gave is. If it isn't
+// exactly one, area is empty and reply is what to say instead: which
+// one they meant, or the areas we do know about
+func resolveArea(name string) (area string, reply string) {
+	matches := matchAreas(name)
+	if len(matches) == 1 {
+		return matches[0], ""
+	}
+
+	if len(matches) > 1 {
+		// Ask which one they meant
+		last := len(matches) - 1
+		return "", fmt.Sprintf("Did you mean %s or %s? Try again with one of those",
+			quoteAreas(matches[:last]), quoteAreas(matches[last:]))
+	}
+
+	areas := knownAreas()
+	if len(areas) == 0 {
+		return "", "I don't know of any areas yet"
+	}
+	sort.Strings(areas)
+
+	reply = "Hmm, which area? (case insensitive)"
+	if len(strings.TrimSpace(name)) > 0 {
+		reply = fmt.Sprintf("Hmm, I don't know of an area called `%s`", strings.TrimSpace(name))
+	}
+	return "", reply + "\n_I currently know of the following areas:_ " + quoteAreas(areas)
+}
+
+// quoteAreas is the areas in backticks, separated by commas
+func quoteAreas(areas []string) string {
+	var quoted []string
+	for _, area := range areas {
+		quoted = append(quoted, fmt.Sprintf("`%s`", area))
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pumpingstationone/shopmon/shared/registry"
+)
+
+// useTestAreas sets up the areas (as if we'd seen someone in each of
+// them) and aliases to match against
+func useTestAreas(t *testing.T) {
+	t.Helper()
+	sensors = registry.New("")
+
+	now := time.Now()
+	sensorMap = make(map[string]time.Time)
+	for _, area := range []string{"Woodshop", "Cold Metals", "Hot Metals", "CNC Lounge", "Electronics Lab", "Dock", "Dock Door"} {
+		sensorMap[area] = now
+	}
+
+	areaAliases = map[string]string{
+		"welding": "Hot Metals",
+		"saw":     "Woodshop",
+	}
+	t.Cleanup(func() { areaAliases = make(map[string]string) })
+}
+
+func TestMatchAreas(t *testing.T) {
+	useTestAreas(t)
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		// The name, ignoring case, spaces and punctuation
+		{"woodshop", []string{"Woodshop"}},
+		{"Cold Metals", []string{"Cold Metals"}},
+		{"coldmetals", []string{"Cold Metals"}},
+		{"cold-metals", []string{"Cold Metals"}},
+		// An alias
+		{"welding", []string{"Hot Metals"}},
+		{"Saw", []string{"Woodshop"}},
+		// The whole name wins over names that start with it
+		{"dock", []string{"Dock"}},
+		// The start of a name, or of a word in it
+		{"wood", []string{"Woodshop"}},
+		{"cnc", []string{"CNC Lounge"}},
+		{"lab", []string{"Electronics Lab"}},
+		{"dock d", []string{"Dock Door"}},
+		{"weld", []string{"Hot Metals"}},
+		// Anywhere in the name
+		{"shop", []string{"Woodshop"}},
+		{"tronic", []string{"Electronics Lab"}},
+		// A letter or two off
+		{"woodsop", []string{"Woodshop"}},
+		{"electronic lab", []string{"Electronics Lab"}},
+		// Several, sorted by name
+		{"metals", []string{"Cold Metals", "Hot Metals"}},
+		{"metal", []string{"Cold Metals", "Hot Metals"}},
+		// Nothing
+		{"", nil},
+		{"  ", nil},
+		{"zzz", nil},
+		// Too short to be a letter off
+		{"dok", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := matchAreas(test.name); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("matchAreas(%q) = %q, want %q", test.name, got, test.want)
+			}
+		})
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"woodshop", "woodshop", 0},
+		{"woodsop", "woodshop", 1},
+		{"woodshpo", "woodshop", 2},
+		{"kitten", "sitting", 3},
+	}
+
+	for _, test := range tests {
+		if got := editDistance(test.a, test.b); got != test.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestResolveArea(t *testing.T) {
+	useTestAreas(t)
+
+	if area, reply := resolveArea("wood"); area != "Woodshop" || len(reply) > 0 {
+		t.Errorf("resolveArea(wood) = %q, %q, want Woodshop", area, reply)
+	}
+
+	area, reply := resolveArea("metals")
+	if len(area) > 0 || !strings.Contains(reply, "`Cold Metals` or `Hot Metals`") {
+		t.Errorf("resolveArea(metals) = %q, %q, want it to ask which one", area, reply)
+	}
+
+	area, reply = resolveArea("zzz")
+	if len(area) > 0 || !strings.Contains(reply, "`zzz`") || !strings.Contains(reply, "`Woodshop`") {
+		t.Errorf("resolveArea(zzz) = %q, %q, want the areas we know", area, reply)
+	}
+}
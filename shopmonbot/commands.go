@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+ * Every !command the bot knows is a Command, which each file registers for
+ * itself in an init() with registerCommand(), e.g.
+ *
+ *	func init() {
+ *		registerCommand(&Command{
+ *			Name:    "door",
+ *			Usage:   "<door>",
+ *			Help:    "whether a door is open, and for how long",
+ *			Handler: func(args Args) string { return reportForDoor(args.Text) },
+ *		})
+ *	}
+ *
+ * checkForCommands() finds the first !word in a message that's one of
+ * the commands' triggers (its name or any of its aliases), and hands the
+ * rest of the message to the command's handler. !help is built from the
+ * commands, so a new command shows up in it without anything else to do.
+ */
+
+// Args is what came after the trigger, e.g. for "!area cnc lounge"
+// Text is "cnc lounge" and Words is ["cnc", "lounge"], along with the
+// Slack ID of the user who asked
+type Args struct {
+	Text  string
+	Words []string
+	User  string
+}
+
+// Word returns the i'th word, or nothing if there aren't that many
+func (a Args) Word(i int) string {
+	if i < len(a.Words) {
+		return a.Words[i]
+	}
+	return ""
+}
+
+// Command is something the bot can be asked to do
+type Command struct {
+	// The trigger, e.g. "area" for !area
+	Name string
+	// Other triggers that do the same thing
+	Aliases []string
+	// What goes after the trigger, e.g. "<area>|all", for the help
+	Usage string
+	// What the command does, for the help
+	Help string
+	// Handler works out what to say back
+	Handler func(args Args) string
+}
+
+// Every command, and every trigger for them
+var commands []*Command
+var commandTriggers = make(map[string]*Command)
+
+// A ! followed by a word, which might be a trigger
+var triggerPattern = regexp.MustCompile(`!([a-z0-9_-]+)`)
+
+// registerCommand adds the command to the ones the bot knows about.
+// Two commands with the same trigger is a mistake, so we don't start
+func registerCommand(c *Command) {
+	for _, trigger := range append([]string{c.Name}, c.Aliases...) {
+		if other, ok := commandTriggers[trigger]; ok {
+			panic(fmt.Sprintf("!%s is a trigger for both %s and %s", trigger, other.Name, c.Name))
+		}
+		commandTriggers[trigger] = c
+	}
+	commands = append(commands, c)
+}
+
+// parseArgs splits what came after the trigger into words
+func parseArgs(user, text string) Args {
+	text = strings.TrimSpace(text)
+	return Args{Text: text, Words: strings.Fields(text), User: user}
+}
+
+// This function is where we listen for specific commands. We are not
+// using the Slack "/" commands (well, not here; see slash.go) but rather
+// a more old-school IRC method of using the bang operator ("!") followed
+// by one of the triggers of the registered commands
+func checkForCommands(user, input string) (bool, string) {
+	for _, match := range triggerPattern.FindAllStringSubmatchIndex(input, -1) {
+		command, ok := commandTriggers[input[match[2]:match[3]]]
+		if !ok {
+			continue
+		}
+
+		// Yes we did, so build the response we're going to send back
+		// from everything after the trigger
+		return true, command.Handler(parseArgs(user, input[match[1]:]))
+	}
+
+	return false, ""
+}
+
+// usage is how to use the command, e.g. "`!area <area>|all`"
+func (c *Command) usage() string {
+	if len(c.Usage) == 0 {
+		return fmt.Sprintf("`!%s`", c.Name)
+	}
+	return fmt.Sprintf("`!%s %s`", c.Name, c.Usage)
+}
+
+// helpFor is the help for every command, or just the one asked about
+func helpFor(args Args) string {
+	if name := strings.TrimPrefix(args.Word(0), "!"); len(name) > 0 {
+		c, ok := commandTriggers[name]
+		if !ok {
+			return fmt.Sprintf("I don't know `!%s`, try `!help` to see everything I do know", name)
+		}
+		help := fmt.Sprintf("%s - %s", c.usage(), c.Help)
+		if len(c.Aliases) > 0 {
+			help += "\n_You can also use_ `!" + strings.Join(c.Aliases, "`, `!") + "`"
+		}
+		return help
+	}
+
+	sorted := append([]*Command(nil), commands...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	help := "_Here's what I can do:_\n"
+	for _, c := range sorted {
+		help += fmt.Sprintf("%s - %s\n", c.usage(), c.Help)
+	}
+	return strings.TrimSpace(help)
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "help",
+		Usage:   "[command]",
+		Help:    "lists everything I can do, or tells you more about one thing",
+		Handler: helpFor,
+	})
+}
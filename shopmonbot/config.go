@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pumpingstationone/shopmon/shared/mqttclient"
+)
+
+// Config is everything that can be set in config.ini, the
+// environment or on the command line (see the shared/config package)
+type Config struct {
+	Slack   SlackConfig
+	MQTT    mqttclient.Options
+	Topics  TopicConfig
+	Sensors SensorConfig
+	State   StateConfig
+	History HistoryConfig
+	Alerts  AlertConfig
+	Notify  NotifyConfig
+}
+
+// SlackConfig is how we talk to Slack
+type SlackConfig struct {
+	Token string `help:"Slack bot token" secret:"true"`
+	// Messages from this user (i.e. us) are ignored
+	IgnoreUser string `help:"Slack user ID whose messages are ignored"`
+	Debug      bool   `help:"log everything the Slack library does"`
+	// How we get messages from Slack: rtm, socket or events (see
+	// connect.go). Slack doesn't let new apps use rtm any more
+	Mode string `help:"how to get messages from Slack: rtm, socket (Socket Mode) or events (Events API)"`
+	// For Socket Mode
+	AppToken string `help:"Slack app-level token (xapp-...) for Socket Mode" secret:"true"`
+	// For the Events API
+	SigningSecret string `help:"Slack signing secret for the Events API" secret:"true"`
+	Listen        string `help:"address to listen for the Events API on"`
+	EventsPath    string `help:"path Slack sends events to"`
+	CommandsPath  string `help:"path Slack sends slash commands to"`
+	ActionsPath   string `help:"path Slack sends button presses to"`
+}
+
+// TopicConfig is the MQTT topics we use
+type TopicConfig struct {
+	// The topic to listen on. This is specific to how your
+	// topics are set up on the server. You can listen to more
+	// than one at a time in a hierarchy with the octothorp ("#")
+	// character (e.g. "/occupancy/#" ). This is the JSON feed from
+	// sensorstatus, but the old "webshopmontopic" works too
+	Status string `help:"topic to get sensor status from"`
+	// Where sensorstatus tells us about doors opening and closing;
+	// we listen to every door under it
+	Door string `help:"topic prefix to get doors opening and closing from"`
+}
+
+// SensorConfig is where we find out about the sensors
+type SensorConfig struct {
+	File string `help:"the sensors.json file from the sensors program"`
+	// Other names people use for the areas (see areamatch.go)
+	Aliases string `help:"JSON file of other names for areas"`
+}
+
+// StateConfig is where we save what we know between restarts
+type StateConfig struct {
+	File      string        `help:"file to save the last time each area was seen in"`
+	SaveEvery time.Duration `help:"how often to save the last seen times"`
+}
+
+// HistoryConfig is where we keep the history of every sensor
+// for !report (see report.go)
+type HistoryConfig struct {
+	File string `help:"the SQLite database to record history in, or nothing to not keep any"`
+}
+
+// AlertConfig is where and when we say something about doors that
+// have been left open (see alerts.go). These are the defaults for
+// every door, which can be changed per door in the doors file
+type AlertConfig struct {
+	Channel       string        `help:"Slack channel ID to post door alerts in, or nothing to not post any"`
+	After         time.Duration `help:"how long a door can be open before we say something"`
+	EscalateEvery time.Duration `help:"how often to say something again while it's still open"`
+	// e.g. <!here> or <!subteam^S0123> for a user group
+	Mention    string `help:"who to mention when we say something again"`
+	QuietHours string `help:"when not to post anything, e.g. 22:00-07:00"`
+	DoorsFile  string `help:"the JSON file with the settings for each door"`
+}
+
+// NotifyConfig is for DMing people when an area is empty or occupied
+// (see notify.go)
+type NotifyConfig struct {
+	File     string        `help:"file to save who wants to be told about what in"`
+	Cooldown time.Duration `help:"how long before telling someone about the same thing again"`
+}
+
+// defaultConfig is what we use if nothing else is given
+func defaultConfig() Config {
+	return Config{
+		Slack: SlackConfig{
+			Debug:        true,
+			Mode:         "rtm",
+			Listen:       ":3000",
+			EventsPath:   "/slack/events",
+			CommandsPath: "/slack/commands",
+			ActionsPath:  "/slack/actions",
+		},
+		MQTT: mqttclient.Options{
+			Broker: "tcp://10.10.1.224:1883",
+			// The clientID must be a unique name for listening on the
+			// topics, otherwise you may get disconnect errors
+			ClientID: "shopmonbot",
+		},
+		Topics: TopicConfig{
+			Status: "shopmon/status",
+			Door:   "shopmon/door",
+		},
+		Sensors: SensorConfig{
+			File:    "../sensors/sensors.json",
+			Aliases: "aliases.json",
+		},
+		State: StateConfig{
+			File:      "areas.json",
+			SaveEvery: 30 * time.Second,
+		},
+		History: HistoryConfig{
+			File: "history.db",
+		},
+		Alerts: AlertConfig{
+			After:         15 * time.Minute,
+			EscalateEvery: 30 * time.Minute,
+			Mention:       "<!here>",
+			DoorsFile:     "doors.json",
+		},
+		Notify: NotifyConfig{
+			File:     "notifications.json",
+			Cooldown: 15 * time.Minute,
+		},
+	}
+}
+
+// Validate checks the parts of the config that are ours
+func (c *Config) Validate() error {
+	if len(c.Slack.Token) == 0 {
+		return errors.New("no Slack token given")
+	}
+	switch c.Slack.Mode {
+	case "rtm":
+	case "socket":
+		if !strings.HasPrefix(c.Slack.AppToken, "xapp-") {
+			return errors.New("Socket Mode needs an app-level token (xapp-...)")
+		}
+	case "events":
+		if len(c.Slack.SigningSecret) == 0 {
+			return errors.New("the Events API needs a signing secret")
+		}
+	default:
+		return fmt.Errorf("%q isn't a Slack mode; it has to be rtm, socket or events", c.Slack.Mode)
+	}
+	if len(c.Topics.Status) == 0 {
+		return errors.New("no status topic given")
+	}
+	if len(c.State.File) == 0 {
+		return errors.New("no state file given")
+	}
+	if c.State.SaveEvery < time.Second {
+		return errors.New("SaveEvery has to be at least a second")
+	}
+	if len(c.Notify.File) == 0 {
+		return errors.New("no notifications file given")
+	}
+	if c.Notify.Cooldown < 0 {
+		return errors.New("the notification Cooldown can't be negative")
+	}
+	if len(c.Alerts.Channel) > 0 {
+		if c.Alerts.After < time.Minute || c.Alerts.EscalateEvery < time.Minute {
+			return errors.New("After and EscalateEvery have to be at least a minute")
+		}
+		if _, err := parseQuietHours(c.Alerts.QuietHours); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+	"github.com/slack-go/slack/socketmode"
+)
+
+/*
+ * There are three ways of getting messages from Slack, set with Mode in the
+ * Slack section of the config:
+ *
+ *	rtm	the classic RTM API, which is how the bot has always worked,
+ *		but Slack won't let new apps use it any more
+ *	socket	Socket Mode, where we open a websocket to Slack with an
+ *		app-level token (xapp-...), so nothing has to be reachable
+ *		from the internet
+ *	events	the Events API, where Slack sends every event to us over
+ *		HTTP, so we have to be reachable from the internet
+ *
+ * Whichever one it is, every message ends up in checkForCommands() the same
+ * way. With Socket Mode and the Events API the bot needs to be subscribed
+ * to the message.channels (and message.im, for DMs) events and have the
+ * chat:write scope to answer. /shopmon (see slash.go) only works with those
+ * two, as Slack doesn't send slash commands over RTM.
+ */
+
+// answer works out what (if anything) to say to a message from user
+func answer(user, text string) (bool, string) {
+	text = strings.TrimSpace(text)
+	text = strings.ToLower(text)
+
+	//fmt.Println("The user is", user, "the text is", text)
+	if user == cfg.Slack.IgnoreUser {
+		return false, ""
+	}
+
+	// Let's see if someone asked us for something...
+	return checkForCommands(user, text)
+}
+
+// answerEvent answers a message from Socket Mode or the Events API.
+// These include our own messages (and edits, joins and so on), which
+// we don't want to answer
+func answerEvent(api *slack.Client, ev *slackevents.MessageEvent) {
+	if len(ev.BotID) > 0 || len(ev.SubType) > 0 {
+		return
+	}
+
+	if sendResponse, response := answer(ev.User, ev.Text); sendResponse {
+		// ...yep, we have something to say, so let's send it to the channel
+		if _, _, err := api.PostMessage(ev.Channel, slack.MsgOptionText(response, false)); err != nil {
+			fmt.Println("Could not answer:", err)
+		}
+	}
+}
+
+// runRTM gets messages over the RTM API until the context is cancelled
+// or Slack doesn't like our token
+func runRTM(ctx context.Context, api *slack.Client) {
+	rtm := api.NewRTM()
+	go rtm.ManageConnection()
+
+	for {
+		select {
+		case msg := <-rtm.IncomingEvents:
+			switch ev := msg.Data.(type) {
+			case *slack.MessageEvent:
+				sendResponse, response := answer(ev.User, ev.Text)
+
+				if sendResponse {
+					// ...yep, we sent something back, so let's send it to the channel
+					rtm.SendMessage(rtm.NewOutgoingMessage(response, ev.Channel))
+				}
+
+			case *slack.RTMError:
+				fmt.Printf("Error: %s\n", ev.Error())
+
+			case *slack.InvalidAuthEvent:
+				fmt.Printf("Invalid credentials")
+				return
+
+			default:
+				// Nothin' to do
+				//fmt.Printf(".")
+			}
+
+		case <-ctx.Done():
+			// We've been told to stop
+			rtm.Disconnect()
+			return
+		}
+	}
+}
+
+// runSocketMode gets messages over Socket Mode until the context is
+// cancelled or Slack doesn't like our token
+func runSocketMode(ctx context.Context, api *slack.Client) {
+	client := socketmode.New(api, socketmode.OptionDebug(cfg.Slack.Debug))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		if err := client.RunContext(ctx); err != nil && ctx.Err() == nil {
+			fmt.Println("Socket Mode stopped:", err)
+			cancel()
+		}
+	}()
+
+	for {
+		select {
+		case evt := <-client.Events:
+			switch evt.Type {
+			case socketmode.EventTypeEventsAPI:
+				// Slack wants to know we got it straight away, or
+				// it'll send it again
+				if evt.Request != nil {
+					client.Ack(*evt.Request)
+				}
+				event, ok := evt.Data.(slackevents.EventsAPIEvent)
+				if !ok {
+					continue
+				}
+				if ev, ok := event.InnerEvent.Data.(*slackevents.MessageEvent); ok {
+					answerEvent(api, ev)
+				}
+
+			case socketmode.EventTypeSlashCommand:
+				// The answer to a slash command goes back with
+				// the acknowledgement (see slash.go)
+				command, ok := evt.Data.(slack.SlashCommand)
+				if !ok || evt.Request == nil {
+					continue
+				}
+				client.Ack(*evt.Request, slashReply(command.Text))
+
+			case socketmode.EventTypeInteractive:
+				// Someone pressed the refresh button
+				if evt.Request != nil {
+					client.Ack(*evt.Request)
+				}
+				callback, ok := evt.Data.(slack.InteractionCallback)
+				if !ok {
+					continue
+				}
+				go answerInteraction(callback)
+
+			case socketmode.EventTypeConnectionError:
+				fmt.Println("Error:", evt.Data)
+
+			case socketmode.EventTypeInvalidAuth:
+				fmt.Printf("Invalid credentials")
+				return
+
+			default:
+				// Nothin' to do
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runEventsAPI listens for Slack to send us events over HTTP until
+// the context is cancelled
+func runEventsAPI(ctx context.Context, api *slack.Client) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.Slack.EventsPath, func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(w, r, api)
+	})
+	mux.HandleFunc(cfg.Slack.CommandsPath, serveCommands)
+	mux.HandleFunc(cfg.Slack.ActionsPath, serveActions)
+	server := &http.Server{Addr: cfg.Slack.Listen, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Println("Listening for Slack events on", cfg.Slack.Listen+cfg.Slack.EventsPath)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fmt.Println("Could not listen for Slack events:", err)
+	}
+}
+
+// answerInteraction answers someone pressing a button, by replacing
+// the message the button was on
+func answerInteraction(callback slack.InteractionCallback) {
+	if callback.Type != slack.InteractionTypeBlockActions {
+		return
+	}
+	if reply := refreshReply(callback); reply != nil {
+		if err := slack.PostWebhook(callback.ResponseURL, reply); err != nil {
+			fmt.Println("Could not refresh:", err)
+		}
+	}
+}
+
+// verifiedBody reads the body of a request from Slack, making sure it
+// really is from Slack. If it isn't, the error has already been sent
+// back and we return nil
+func verifiedBody(w http.ResponseWriter, r *http.Request) []byte {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	verifier, err := slack.NewSecretsVerifier(r.Header, cfg.Slack.SigningSecret)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	verifier.Write(body)
+	if err := verifier.Ensure(); err != nil {
+		http.Error(w, "Not from Slack", http.StatusUnauthorized)
+		return nil
+	}
+
+	return body
+}
+
+// serveCommands handles a slash command from Slack, and the answer
+// goes straight back in the response
+func serveCommands(w http.ResponseWriter, r *http.Request) {
+	body := verifiedBody(w, r)
+	if body == nil {
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(slashReply(form.Get("text")))
+}
+
+// serveActions handles someone pressing a button. Slack just wants to
+// know we got it, and the answer goes to the response URL
+func serveActions(w http.ResponseWriter, r *http.Request) {
+	body := verifiedBody(w, r)
+	if body == nil {
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var callback slack.InteractionCallback
+	if err := json.Unmarshal([]byte(form.Get("payload")), &callback); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	go answerInteraction(callback)
+}
+
+// serveEvents handles a single request from the Events API, after
+// making sure it really is from Slack
+func serveEvents(w http.ResponseWriter, r *http.Request, api *slack.Client) {
+	body := verifiedBody(w, r)
+	if body == nil {
+		return
+	}
+
+	event, err := slackevents.ParseEvent(json.RawMessage(body), slackevents.OptionNoVerifyToken())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch event.Type {
+	case slackevents.URLVerification:
+		// Slack checking that we're the right URL when the app is
+		// set up
+		var challenge slackevents.ChallengeResponse
+		if err := json.Unmarshal(body, &challenge); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(challenge.Challenge))
+
+	case slackevents.CallbackEvent:
+		// Slack wants an answer within three seconds, so we answer
+		// the message separately
+		if ev, ok := event.InnerEvent.Data.(*slackevents.MessageEvent); ok {
+			go answerEvent(api, ev)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pumpingstationone/shopmon/shared/message"
+)
+
+/*
+ * sensorstatus tells us whenever a door (or window) opens or closes (see
+ * door.go over there), and keeps the latest for each door on a retained
+ * topic, so as soon as we connect we know the state of every door. That's
+ * what !door <name> answers from, e.g. "The `Dock-Door` is *open*, and has
+ * been for *23 minutes*".
+ */
+
+// The latest message for each door, keyed by the door's name
+var doors = make(map[string]message.DoorEvent)
+var doorMutex = &sync.Mutex{}
+
+// The last time each door closed, so we know how long it was open even
+// if it's been opened again since (see checkDoors() in alerts.go);
+// guarded by the same mutex
+var lastClosed = make(map[string]message.DoorEvent)
+
+// onDoorReceived keeps track of the latest message for each door
+func onDoorReceived(topic string, payload []byte) {
+	door, err := message.ParseDoor(payload)
+	if err != nil {
+		fmt.Println("Ignoring door message:", err)
+		return
+	}
+
+	doorMutex.Lock()
+	doors[door.Door] = door
+	if !door.Open() {
+		lastClosed[door.Door] = door
+	}
+	doorMutex.Unlock()
+}
+
+// doorNames returns every door we know about, from sensors.json and
+// the messages we've had, sorted by name
+func doorNames() []string {
+	known := make(map[string]bool)
+	for _, s := range sensors.Sensors() {
+		if message.IsOpening(s.Kind) {
+			known[s.Name] = true
+		}
+	}
+	doorMutex.Lock()
+	for name := range doors {
+		known[name] = true
+	}
+	doorMutex.Unlock()
+
+	var names []string
+	for name := range known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// doorArea is the area the door is in, if we know it
+func doorArea(name string) string {
+	if s, ok := sensors.Lookup(name); ok {
+		return s.Area
+	}
+	doorMutex.Lock()
+	defer doorMutex.Unlock()
+	return doors[name].Area
+}
+
+// doorLine says whether the door is open, and for how long
+func doorLine(name string, now time.Time) string {
+	doorMutex.Lock()
+	door, ok := doors[name]
+	doorMutex.Unlock()
+
+	switch {
+	case !ok:
+		return fmt.Sprintf("I haven't heard anything about the `%s` yet", name)
+	case door.Open():
+		return fmt.Sprintf("The `%s` is *open*, and has been for *%s*", name, formatTime(door.OpenFor(now)))
+	case door.Duration > 0:
+		return fmt.Sprintf("The `%s` is closed; it was last open for %s, *%s* ago",
+			name, formatTime(door.OpenFor(now)), formatTime(now.Sub(door.Time())))
+	default:
+		return fmt.Sprintf("The `%s` is closed", name)
+	}
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "door",
+		Aliases: []string{"doors"},
+		Usage:   "[door]",
+		Help:    "whether a door is open, and for how long, or every door",
+		Handler: func(args Args) string { return reportForDoor(args.Text) },
+	})
+}
+
+func reportForDoor(wanted string) string {
+	// We're looking for a message in the form of !door <door name>,
+	// where the name can be the door's name (e.g. "dock-door"), its
+	// area (e.g. "dock door") or just part of either (e.g. "dock")
+	wanted = strings.ToLower(wanted)
+
+	names := doorNames()
+	if len(names) == 0 {
+		return "I don't know of any doors"
+	}
+
+	now := time.Now()
+	response := ""
+	doorList := ""
+	for _, name := range names {
+		area := strings.ToLower(doorArea(name))
+		if len(wanted) == 0 || wanted == "all" ||
+			strings.Contains(strings.ToLower(name), wanted) || strings.Contains(area, wanted) {
+			response += doorLine(name, now) + "\n"
+		}
+		doorList += fmt.Sprintf("`%s`, ", name)
+	}
+
+	if len(response) == 0 {
+		return "Hmm, you want to enter `!door <door>` (case insensitive).\n_I currently know of the following doors:_ " +
+			trimSuffix(strings.TrimSpace(doorList), ",")
+	}
+
+	return strings.TrimSpace(response)
+}
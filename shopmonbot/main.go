@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"regexp"
-	"strconv"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
-	"gopkg.in/ini.v1"
+
+	"github.com/pumpingstationone/shopmon/shared/config"
+	"github.com/pumpingstationone/shopmon/shared/message"
+	"github.com/pumpingstationone/shopmon/shared/registry"
 	"github.com/slack-go/slack"
 )
 
@@ -25,6 +30,17 @@ var statusChannel chan StatusMessage
 var sensorMap map[string]time.Time
 var mutex = &sync.Mutex{}
 
+// The sensors that are on right now and the area each one is in,
+// so we know who's in the space (for /shopmon open); guarded by the
+// same mutex
+var sensorsOn = make(map[string]string)
+
+// Our settings (see config.go)
+var cfg = defaultConfig()
+
+// Every sensor we know about, from sensors.json
+var sensors *registry.Registry
+
 func trimSuffix(s, suffix string) string {
 	if strings.HasSuffix(s, suffix) {
 		s = s[:len(s)-len(suffix)]
@@ -85,31 +101,66 @@ func formatTime(duration time.Duration) string {
 	return trimSuffix(strings.TrimSpace(timeLine), ",")
 }
 
-func reportForArea(input string) string {
+// lastSeenLine says when the area was last used, in the right words
+// for the kind of sensor in it; a door is open rather than having
+// someone in it
+func lastSeenLine(area, timeInfo string) string {
+	kind := sensors.AreaKind(area)
+	switch {
+	case message.IsOpening(kind):
+		return fmt.Sprintf("The `%s` was last open *%s* ago", area, timeInfo)
+	case kind == message.KindPanel, kind == message.KindTamper:
+		return fmt.Sprintf("The `%s` was last triggered *%s* ago", area, timeInfo)
+	default:
+		return fmt.Sprintf("There was someone in `%s` *%s* ago", area, timeInfo)
+	}
+}
+
+// neverSeenLine is lastSeenLine for an area we haven't seen anything
+// in yet
+func neverSeenLine(area string) string {
+	kind := sensors.AreaKind(area)
+	switch {
+	case message.IsOpening(kind):
+		return fmt.Sprintf("I haven't seen the `%s` open yet", area)
+	case kind == message.KindPanel, kind == message.KindTamper:
+		return fmt.Sprintf("I haven't seen the `%s` triggered yet", area)
+	default:
+		return fmt.Sprintf("I haven't seen anyone in `%s` yet", area)
+	}
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "area",
+		Usage:   "<area>|all",
+		Help:    "when someone was last in an area, or every area",
+		Handler: func(args Args) string { return reportForArea(args.Text) },
+	})
+}
+
+func reportForArea(area string) string {
 	message := ""
 
 	// We're looking for a message in the form of !area <area name>
 	// and if we don't find that, we'll inform them of the areas we
 	// do know about (this is read from the map so it can be kept dynamic
-	// as more areas come online)
-
-	area := ""
-	areaParts := strings.Split(input, "!area")
-	if len(areaParts) > 1 {
-		area = strings.TrimSpace(areaParts[1])
-		fmt.Println("The area we want is:", area)
-	}
+	// as more areas come online, along with the areas in sensors.json)
+	fmt.Println("The area we want is:", area)
 
 	getAllAreas := false
 	if strings.ToLower(area) == "all" {
 		getAllAreas = true
+	} else {
+		// People don't remember exactly what the areas are called,
+		// so find the one they probably meant (see areamatch.go)
+		found, reply := resolveArea(area)
+		if len(found) == 0 {
+			return reply + "\nYou can also type `!area all` to get everything"
+		}
+		area = found
 	}
 
-	// These two strings are for building the help message in case
-	// we didn't get an area or an unknown area
-	helpMsg := "Hmm, you want to enter `!area <area>` (case insensitive).\n_I currently know of the following areas:_ "
-	areaList := ""
-
 	// If we did find the area, this will tell us when it was last occupied
 	areaStatus := ""
 
@@ -128,34 +179,36 @@ func reportForArea(input string) string {
 			timeInfo := formatTime(diff)
 
 			// Build our response line with it, putting the time part in bold
+			areaStatus += lastSeenLine(k, timeInfo)
 
-			// If this is a door, we should alter the text a little
-			if strings.Contains(k, "Door") {
-				areaStatus += fmt.Sprintf("The `%s` was last open *%s* ago", k, timeInfo)
-			} else {
-				areaStatus += fmt.Sprintf("There was someone in `%s` *%s* ago", k, timeInfo)
+			// If we're getting all areas, we're gonna make it one-line-per
+			if getAllAreas == true {
+				areaStatus += "\n"
 			}
+			foundArea = true
+		}
+	}
 
-			// If we're getting all areas, we're gonna make it one-line-per
+	// There may also be areas in sensors.json that no one has been in
+	// since we started, and we want to know about those too
+	for _, k := range sensors.Areas() {
+		if _, seen := sensorMap[k]; seen {
+			continue
+		}
+		if (getAllAreas == true) || (strings.ToLower(k) == strings.ToLower(area)) {
+			areaStatus += neverSeenLine(k)
 			if getAllAreas == true {
 				areaStatus += "\n"
 			}
 			foundArea = true
 		}
-		// And while we're here, let's build the help text
-		areaList += fmt.Sprintf("`%s`, ", k)
 	}
 	mutex.Unlock()
 
-	// And spiffy up the help message a little...
-	areaList = trimSuffix(strings.TrimSpace(areaList), ",")
-	helpMsg += areaList
-	helpMsg += "\nYou can also type `!area all` to get everything"
-
-	// If we didn't find the area the user wanted, then show
-	// the help message
+	// If we didn't find anything (there aren't any areas yet), then
+	// say so
 	if foundArea == false {
-		message = helpMsg
+		message = "I don't know of any areas yet"
 	} else {
 		// Ah we have something to return to them
 		message = areaStatus
@@ -164,27 +217,6 @@ func reportForArea(input string) string {
 	return message
 }
 
-// This function is where we listen for specific commands. We are not
-// using the Slack "/" commands but rather a more old-school IRC method
-// of using the bang operator ("!") and in this case the trigger word
-// we want is "area"
-func checkForCommands(input string) (bool, string) {
-	response := ""
-	sendResponse := false
-	
-	// Did we find our command?
-	matched, _ := regexp.MatchString("!area", input)
-	if matched {
-		// Yes we did, so we're going to indicate that we have something
-		// to send back...
-		sendResponse = true
-		// ... and build the response we are going to send back
-		response = reportForArea(strings.TrimSpace(input))
-	}
-
-	return sendResponse, response
-}
-
 // This function, well, keeps track of the various areas insofar
 // as that when we get a message from MQTT, we're going to add it
 // to the map of area->last seen time and we keep updating the
@@ -196,22 +228,22 @@ func keepTrackOfAreas() {
 		// Get our message from the MQTT topic
 		statusMsg := <-statusChannel
 
-		// And split it up into its various parts
-		lineParts := strings.Split(statusMsg.spaceStatus, ",")
-		i, err := strconv.ParseInt(lineParts[0], 10, 64)
+		// And turn it into something we can work with; this
+		// understands both the JSON and the old comma-separated
+		// form of the message
+		event, err := message.Parse([]byte(statusMsg.spaceStatus))
 		if err != nil {
-			panic(err)
+			fmt.Println("Ignoring message:", err)
+			continue
 		}
 
-		// Okay, the message we got from the topic should be in the
-		// form of:
-		//		1597446363,Lasers-1:CNC Lounge,1
+		// sensors.json knows best which area a sensor is in
+		sensors.Enrich(&event)
+
 		// Here we're not interested in the individual sensor but the area
-		// so going to take lineParts[1] and further split that into what
-		// we want
-		area := strings.Split(lineParts[1], ":")[1]
+		area := event.Area
 		if len(area) == 0 {
-			fmt.Println("No area for", lineParts[1])
+			fmt.Println("No area for", event.Sensor)
 			continue
 		}
 
@@ -224,8 +256,15 @@ func keepTrackOfAreas() {
 			continue
 		}
 
+		// Write it down for !report
+		if historyDB != nil {
+			if err := historyDB.RecordStatus(event, time.Now()); err != nil {
+				fmt.Println(err)
+			}
+		}
+
 		// Convert the unix timestamp to a time object for the map
-		tm := time.Unix(i, 0)
+		tm := event.Time()
 		mutex.Lock()
 
 		// Check to see if there's already an entry for this sensor in the map
@@ -239,79 +278,128 @@ func keepTrackOfAreas() {
 		// Now we add our entry into the map so the buildTimeLine() function
 		// can evaulate it
 		sensorMap[area] = tm
+		sensorMapChanged = true
+
+		// And whether there's someone in it right now
+		wasOccupied := areaOccupied(area)
+		if event.On() {
+			sensorsOn[event.Sensor] = area
+		} else {
+			delete(sensorsOn, event.Sensor)
+		}
+		isOccupied := areaOccupied(area)
 		mutex.Unlock()
+
+		// If that's changed, anyone who asked gets told (see notify.go).
+		// If Slack is being slow and the notifications have backed up,
+		// we drop the change rather than stop keeping track of the areas
+		if isOccupied != wasOccupied {
+			select {
+			case areaChangeChannel <- AreaChange{area: area, occupied: isOccupied, at: time.Now()}:
+			default:
+				fmt.Println("Too many notifications waiting, dropping the change to", area)
+			}
+		}
 	}
 }
 
 func main() {
 	fmt.Println("Okay, here we go...")
-	
-	// Now get the slack token from the ini file
-	cfg, err := ini.Load("config.ini")
-    	if err != nil {
-        	fmt.Printf("Failed to read config file: %v\n", err)
-        	return
-    	}
 
-    	botToken := cfg.Section("Slack").Key("Token").String()
-	ignoreUser := cfg.Section("Slack").Key("IgnoreUser").String()
+	// Now get our settings, including the slack token, from the
+	// ini file (and/or the environment and command line)
+	if err := config.Load("shopmonbot", &cfg, os.Args[1:]); err != nil {
+		fmt.Printf("Failed to read config: %v\n", err)
+		return
+	}
+
+	// Find out what sensors (and so what areas) we have. If the file
+	// isn't there yet we'll just go with the areas we see, and pick
+	// it up when it shows up
+	sensors = registry.New(cfg.Sensors.File)
+	if err := sensors.Reload(); err != nil {
+		fmt.Println("Could not load sensors:", err)
+	}
+	if err := loadAliases(cfg.Sensors.Aliases); err != nil {
+		fmt.Println("Could not load area aliases:", err)
+	}
+
+	// And where we keep the history for !report
+	openHistory()
+	if historyDB != nil {
+		defer historyDB.Close()
+	}
 
 	// The channel we're going to receive messages on
 	statusChannel = make(chan StatusMessage)
 
 	// Create our map that will hold the key of area
-	// to its timestamp
+	// to its timestamp, and fill it in with what we
+	// knew the last time we were running
 	sensorMap = make(map[string]time.Time)
+	if err := loadAreas(cfg.State.File); err != nil {
+		fmt.Println("Could not load areas:", err)
+	}
+
+	// And who wants to be told about what (for !notify)
+	if err := loadSubscriptions(cfg.Notify.File); err != nil {
+		fmt.Println("Could not load notifications:", err)
+	}
+
+	// Everything runs until we get told to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Now start the mqtt stuff so we can start getting messages
-	go listenOnTopic()
+	// Now start the mqtt stuff so we can start getting messages. We
+	// don't wait for it, as we can still answer with what we know
+	// while we wait for the MQTT server to show up
+	go func() {
+		if err := listenOnTopic(ctx); err != nil && ctx.Err() == nil {
+			fmt.Println("Could not listen on MQTT topic:", err)
+		}
+	}()
 
 	// And start our bookkeeping routine
 	go keepTrackOfAreas()
 
+	// Pick up any changes to sensors.json as they happen
+	go sensors.Watch(ctx)
+
+	// And save what we know every so often so we still know
+	// it after a restart
+	go saveAreasPeriodically(ctx, cfg.State.File, cfg.State.SaveEvery)
+
 	//
 	// Now begins the Slack stuff
 	//
-	// For debugging, use the one with the Debug option
-	api := slack.New(botToken, slack.OptionDebug(true))
-	rtm := api.NewRTM()
-	go rtm.ManageConnection()
+	// For debugging, set Debug in the Slack section of the config
+	api := slack.New(cfg.Slack.Token, slack.OptionDebug(cfg.Slack.Debug),
+		slack.OptionAppLevelToken(cfg.Slack.AppToken))
+
+	// Let people know when a door has been left open
+	if len(cfg.Alerts.Channel) > 0 {
+		if err := loadDoorRules(cfg.Alerts.DoorsFile); err != nil {
+			fmt.Println("Could not load door rules:", err)
+		}
+		go watchDoors(ctx, api)
+	}
 
-Loop:
-	for {
-		select {
-		case msg := <-rtm.IncomingEvents:
-			switch ev := msg.Data.(type) {
-			case *slack.MessageEvent:
-				text := ev.Text
-				text = strings.TrimSpace(text)
-				text = strings.ToLower(text)
-
-				user := ev.User
-				//fmt.Println("The user is", user, "the text is", text)
-				if user == ignoreUser {
-					continue
-				}	
-					
-				// Let's see if someone asked us for something...
-				sendResponse, response := checkForCommands(text)
-
-				if sendResponse {
-					// ...yep, we sent something back, so let's send it to the channel
-					rtm.SendMessage(rtm.NewOutgoingMessage(response, ev.Channel))
-				}
-				
-			case *slack.RTMError:
-				fmt.Printf("Error: %s\n", ev.Error())
-
-			case *slack.InvalidAuthEvent:
-				fmt.Printf("Invalid credentials")
-				break Loop
+	// DM people who asked to know when an area is empty or occupied
+	go sendNotifications(ctx, api)
+
+	// And now we wait for people to ask us things, until we're
+	// told to stop (see connect.go)
+	switch cfg.Slack.Mode {
+	case "socket":
+		runSocketMode(ctx, api)
+	case "events":
+		runEventsAPI(ctx, api)
+	default:
+		runRTM(ctx, api)
+	}
 
-			default:
-				// Nothin' to do
-				//fmt.Printf(".")
-			}
-		}
+	// One last save so we don't lose anything since the last one
+	if err := saveAreas(cfg.State.File); err != nil {
+		fmt.Println("Could not save areas:", err)
 	}
 }
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+/*
+ * People waiting for a shared machine want to know when it frees up, so
+ * they can ask the bot to DM them when an area becomes empty (or occupied):
+ *
+ *	!notify woodshop when empty
+ *	!notify cold metals when occupied
+ *	!notify list			what you've asked to be told about
+ *	!notify cancel woodshop		stop telling you about the woodshop
+ *	!notify cancel all		stop telling you about anything
+ *
+ * An area is occupied while any of its sensors are on, which we keep track
+ * of in keepTrackOfAreas(), which tells us here (on areaChangeChannel)
+ * whenever an area goes from empty to occupied or back again (unless so many
+ * are waiting to be sent that the channel is full, in which case the change
+ * is dropped, so a slow Slack can't hold up everything else). A sensor that
+ * keeps going on and off would send a DM every time, so each subscription
+ * isn't sent again until the cool-down (from the config) is up. Anything we
+ * held back is sent once the cool-down is up, if the area is still empty
+ * (or occupied), so no one misses the machine freeing up.
+ *
+ * Subscriptions stay until they're cancelled, and are saved to a JSON file
+ * whenever they change, so they survive a restart.
+ */
+
+// AreaChange is an area going from empty to occupied, or back again,
+// sent from keepTrackOfAreas() to sendNotifications()
+type AreaChange struct {
+	area     string
+	occupied bool
+	at       time.Time
+}
+
+// Our channel of area changes
+var areaChangeChannel = make(chan AreaChange, 100)
+
+// When we started. We don't know which areas were occupied before
+// then, so the first while of changes are just us finding out
+var startedAt = time.Now()
+
+// How long after we start before we believe the changes
+const notifySettle = time.Minute
+
+// How often we check for held back notifications whose cool-down is up
+const notifyCheckEvery = 30 * time.Second
+
+// Subscription is someone wanting to know when an area is empty or
+// occupied
+type Subscription struct {
+	User string `json:"user"`
+	Area string `json:"area"`
+	// "empty" or "occupied"
+	When         string    `json:"when"`
+	Created      time.Time `json:"created"`
+	LastNotified time.Time `json:"last_notified"`
+
+	// Whether we held one back because of the cool-down
+	pending bool
+}
+
+// Everyone's subscriptions, and the guard for them
+var subscriptions []*Subscription
+var notifyMutex = &sync.Mutex{}
+
+// The words people use for empty and occupied
+var notifyConditions = map[string]string{
+	"empty":    "empty",
+	"free":     "empty",
+	"clear":    "empty",
+	"occupied": "occupied",
+	"busy":     "occupied",
+	"used":     "occupied",
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "notify",
+		Usage:   "<area> when empty|occupied, list or cancel <area>|all",
+		Help:    "DMs you when an area becomes empty or occupied",
+		Handler: notifyCommand,
+	})
+}
+
+// areaOccupied reports whether any of the area's sensors are on. The
+// caller must hold the mutex
+func areaOccupied(area string) bool {
+	for _, a := range sensorsOn {
+		if a == area {
+			return true
+		}
+	}
+	return false
+}
+
+// loadSubscriptions reads the saved subscriptions. A missing file just
+// means no one has asked for anything yet
+func loadSubscriptions(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved []*Subscription
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("bad notifications file %s: %v", path, err)
+	}
+
+	notifyMutex.Lock()
+	subscriptions = saved
+	notifyMutex.Unlock()
+
+	fmt.Printf("Loaded %d notifications from %s\n", len(saved), path)
+
+	return nil
+}
+
+// saveSubscriptions writes the subscriptions to the file. The caller
+// must hold notifyMutex
+func saveSubscriptions() {
+	data, err := json.MarshalIndent(subscriptions, "", "  ")
+	if err == nil {
+		err = writeFileAtomically(cfg.Notify.File, data)
+	}
+	if err != nil {
+		fmt.Println("Could not save notifications:", err)
+	}
+}
+
+func notifyCommand(args Args) string {
+	switch args.Word(0) {
+	case "", "list":
+		return listSubscriptions(args.User)
+	case "cancel", "stop":
+		return cancelSubscriptions(args.User, strings.TrimSpace(strings.TrimPrefix(args.Text, args.Word(0))))
+	}
+
+	// We're looking for a message in the form of
+	// !notify <area name> when <empty or occupied>
+	help := "Hmm, you want to enter `!notify <area> when empty` or `!notify <area> when occupied`"
+	i := strings.LastIndex(args.Text, " when ")
+	if i < 0 {
+		return help
+	}
+	wanted := strings.TrimSpace(args.Text[:i])
+	when, ok := notifyConditions[strings.TrimSpace(args.Text[i+len(" when "):])]
+	if !ok {
+		return help
+	}
+
+	area, reply := resolveArea(wanted)
+	if len(area) == 0 {
+		return reply
+	}
+
+	notifyMutex.Lock()
+	defer notifyMutex.Unlock()
+
+	for _, s := range subscriptions {
+		if s.User == args.User && s.Area == area && s.When == when {
+			return fmt.Sprintf("I'm already going to tell you when `%s` is %s", area, when)
+		}
+	}
+	subscriptions = append(subscriptions, &Subscription{
+		User:    args.User,
+		Area:    area,
+		When:    when,
+		Created: time.Now(),
+	})
+	saveSubscriptions()
+
+	return fmt.Sprintf("Okay, I'll DM you whenever `%s` is %s (until you tell me `!notify cancel %s`)",
+		area, when, strings.ToLower(area))
+}
+
+// listSubscriptions is everything the user has asked to be told about
+func listSubscriptions(user string) string {
+	notifyMutex.Lock()
+	defer notifyMutex.Unlock()
+
+	var lines []string
+	for _, s := range subscriptions {
+		if s.User == user {
+			lines = append(lines, fmt.Sprintf("`%s` when it's %s", s.Area, s.When))
+		}
+	}
+	if len(lines) == 0 {
+		return "You haven't asked me to tell you about anything. Try `!notify <area> when empty`"
+	}
+	sort.Strings(lines)
+
+	return "_I'll DM you about:_\n" + strings.Join(lines, "\n")
+}
+
+// cancelSubscriptions stops telling the user about the area, or about
+// everything
+func cancelSubscriptions(user, wanted string) string {
+	area := ""
+	if wanted != "all" {
+		var reply string
+		if area, reply = resolveArea(wanted); len(area) == 0 {
+			return reply + "\nOr `!notify cancel all` to cancel everything"
+		}
+	}
+
+	notifyMutex.Lock()
+	defer notifyMutex.Unlock()
+
+	kept := subscriptions[:0]
+	cancelled := 0
+	for _, s := range subscriptions {
+		if s.User == user && (len(area) == 0 || s.Area == area) {
+			cancelled++
+			continue
+		}
+		kept = append(kept, s)
+	}
+	subscriptions = kept
+
+	if cancelled == 0 {
+		return "You weren't getting anything about that anyway"
+	}
+	saveSubscriptions()
+
+	if len(area) == 0 {
+		return "Okay, I won't DM you about anything any more"
+	}
+	return fmt.Sprintf("Okay, I won't DM you about `%s` any more", area)
+}
+
+// sendNotifications DMs everyone who wants to know about each area
+// change, and anything held back whose cool-down is up, until the
+// context is cancelled
+func sendNotifications(ctx context.Context, api *slack.Client) {
+	ticker := time.NewTicker(notifyCheckEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case change := <-areaChangeChannel:
+			if change.at.Sub(startedAt) < notifySettle {
+				continue
+			}
+			sendSubscriptions(api, dueSubscriptions(change))
+		case now := <-ticker.C:
+			sendSubscriptions(api, heldBackSubscriptions(now))
+		}
+	}
+}
+
+// sendSubscriptions DMs each of the subscriptions
+func sendSubscriptions(api *slack.Client, due []Subscription) {
+	for _, s := range due {
+		text := fmt.Sprintf(":bell: `%s` is %s now", s.Area, s.When)
+		if _, _, err := api.PostMessage(s.User, slack.MsgOptionText(text, false)); err != nil {
+			fmt.Println("Could not send notification:", err)
+		}
+	}
+}
+
+// dueSubscriptions finds the subscriptions for the change that haven't
+// been sent in the last cool-down, and marks them as sent. The ones
+// that have are held back until it's up (see heldBackSubscriptions())
+func dueSubscriptions(change AreaChange) []Subscription {
+	when := "empty"
+	if change.occupied {
+		when = "occupied"
+	}
+
+	notifyMutex.Lock()
+	defer notifyMutex.Unlock()
+
+	var due []Subscription
+	for _, s := range subscriptions {
+		if s.Area != change.area || s.When != when {
+			continue
+		}
+		if change.at.Sub(s.LastNotified) < cfg.Notify.Cooldown {
+			s.pending = true
+			continue
+		}
+		s.pending = false
+		s.LastNotified = change.at
+		due = append(due, *s)
+	}
+	if len(due) > 0 {
+		saveSubscriptions()
+	}
+
+	return due
+}
+
+// heldBackSubscriptions finds the subscriptions we held back whose
+// cool-down is up, and marks them as sent if their area is still empty
+// (or occupied). If it isn't any more, there's nothing to tell them
+func heldBackSubscriptions(now time.Time) []Subscription {
+	// Which areas are occupied right now
+	occupied := make(map[string]bool)
+	mutex.Lock()
+	for _, area := range sensorsOn {
+		occupied[area] = true
+	}
+	mutex.Unlock()
+
+	notifyMutex.Lock()
+	defer notifyMutex.Unlock()
+
+	var due []Subscription
+	for _, s := range subscriptions {
+		if !s.pending || now.Sub(s.LastNotified) < cfg.Notify.Cooldown {
+			continue
+		}
+		s.pending = false
+		if occupied[s.Area] != (s.When == "occupied") {
+			continue
+		}
+		s.LastNotified = now
+		due = append(due, *s)
+	}
+	if len(due) > 0 {
+		saveSubscriptions()
+	}
+
+	return due
+}
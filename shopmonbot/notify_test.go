@@ -0,0 +1,92 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useTestSubscriptions sets up the subscriptions, saved to a file that
+// goes away after the test, with a 15 minute cool-down
+func useTestSubscriptions(t *testing.T, subs ...*Subscription) {
+	t.Helper()
+	cfg.Notify.File = filepath.Join(t.TempDir(), "notifications.json")
+	cfg.Notify.Cooldown = 15 * time.Minute
+	subscriptions = subs
+	sensorsOn = make(map[string]string)
+	t.Cleanup(func() {
+		subscriptions = nil
+		sensorsOn = make(map[string]string)
+	})
+}
+
+func TestNotifyCooldown(t *testing.T) {
+	woodshop := &Subscription{User: "U1", Area: "Woodshop", When: "empty"}
+	busy := &Subscription{User: "U2", Area: "Woodshop", When: "occupied"}
+	useTestSubscriptions(t, woodshop, busy)
+	start := time.Now()
+
+	// The first time it's empty, we say so
+	due := dueSubscriptions(AreaChange{area: "Woodshop", occupied: false, at: start})
+	if len(due) != 1 || due[0].User != "U1" {
+		t.Fatalf("first change sent %+v, want just U1", due)
+	}
+
+	// It's empty again five minutes later, which is held back
+	due = dueSubscriptions(AreaChange{area: "Woodshop", occupied: false, at: start.Add(5 * time.Minute)})
+	if len(due) != 0 {
+		t.Fatalf("change during the cool-down sent %+v", due)
+	}
+	if !woodshop.pending {
+		t.Fatal("change during the cool-down wasn't held back")
+	}
+
+	// ...and not sent before the cool-down is up
+	if due := heldBackSubscriptions(start.Add(10 * time.Minute)); len(due) != 0 {
+		t.Fatalf("held back change sent before the cool-down was up: %+v", due)
+	}
+
+	// It's still empty when the cool-down is up, so now we say so
+	due = heldBackSubscriptions(start.Add(16 * time.Minute))
+	if len(due) != 1 || due[0].User != "U1" {
+		t.Fatalf("once the cool-down was up we sent %+v, want just U1", due)
+	}
+	if woodshop.pending {
+		t.Error("held back change is still pending after it was sent")
+	}
+	if !woodshop.LastNotified.Equal(start.Add(16 * time.Minute)) {
+		t.Errorf("last notified at %v, want when the held back change was sent", woodshop.LastNotified)
+	}
+
+	// And only once
+	if due := heldBackSubscriptions(start.Add(17 * time.Minute)); len(due) != 0 {
+		t.Errorf("held back change sent twice: %+v", due)
+	}
+}
+
+func TestNotifyHeldBackNoLongerTrue(t *testing.T) {
+	woodshop := &Subscription{User: "U1", Area: "Woodshop", When: "empty"}
+	useTestSubscriptions(t, woodshop)
+	start := time.Now()
+
+	dueSubscriptions(AreaChange{area: "Woodshop", occupied: false, at: start})
+	dueSubscriptions(AreaChange{area: "Woodshop", occupied: false, at: start.Add(5 * time.Minute)})
+
+	// Someone's in there by the time the cool-down is up, so there's
+	// nothing to tell them
+	sensorsOn["Woodshop-1"] = "Woodshop"
+	if due := heldBackSubscriptions(start.Add(16 * time.Minute)); len(due) != 0 {
+		t.Errorf("sent %+v for an area that isn't empty any more", due)
+	}
+	if woodshop.pending {
+		t.Error("held back change is still pending")
+	}
+
+	// The next time it's empty is after the cool-down, so it's sent
+	// straight away
+	delete(sensorsOn, "Woodshop-1")
+	due := dueSubscriptions(AreaChange{area: "Woodshop", occupied: false, at: start.Add(20 * time.Minute)})
+	if len(due) != 1 {
+		t.Errorf("change after the cool-down sent %+v, want U1", due)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pumpingstationone/shopmon/shared/history"
+)
+
+/*
+ * !report <area> tells you what a typical week looks like in an area, so
+ * you can pick a time to use the table saw when no one else is. The bot
+ * writes down everything it sees in its own history database (see the
+ * history package in shared), and the report is worked out from the last
+ * few weeks of that.
+ */
+
+// The history database, or nil if we've been told not to keep one
+var historyDB *history.DB
+
+// How many weeks the report covers, and how many of the busiest and
+// quietest hours we list
+const (
+	reportWeeks = 4
+	reportSlots = 3
+)
+
+// How busy each hour is in the grid, from no one at all to someone
+// there the whole hour
+var reportShades = []string{" ", ".", ":", "*", "#"}
+
+// openHistory opens the history database if we have one
+func openHistory() {
+	if len(cfg.History.File) == 0 {
+		return
+	}
+
+	var err error
+	historyDB, err = history.Open(cfg.History.File)
+	if err != nil {
+		// Everything else still works without it
+		fmt.Println("Could not open history:", err)
+	}
+}
+
+// knownAreas returns every area we know about, both from sensors.json
+// and the ones we've seen
+func knownAreas() []string {
+	areas := sensors.Areas()
+	known := make(map[string]bool)
+	for _, area := range areas {
+		known[area] = true
+	}
+
+	mutex.Lock()
+	for area := range sensorMap {
+		if !known[area] {
+			areas = append(areas, area)
+		}
+	}
+	mutex.Unlock()
+
+	return areas
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "report",
+		Usage:   "<area>",
+		Help:    "what a typical week in an area looks like",
+		Handler: func(args Args) string { return reportForAreaHistory(args.Text) },
+	})
+}
+
+func reportForAreaHistory(area string) string {
+	// We're looking for a message in the form of !report <area name>
+	if historyDB == nil {
+		return "Sorry, I'm not keeping any history, so I can't tell you what a typical week looks like"
+	}
+
+	// Find the area they want (see areamatch.go)
+	areaName, reply := resolveArea(area)
+	if len(areaName) == 0 {
+		return reply
+	}
+
+	profile, err := historyDB.WeeklyProfile(areaName, reportWeeks, time.Local)
+	if err != nil {
+		fmt.Println("Could not build report:", err)
+		return "Sorry, something went wrong working out the report for `" + areaName + "`"
+	}
+
+	busiest := profile.Busiest(reportSlots)
+	if len(busiest) == 0 {
+		return fmt.Sprintf("I haven't seen anyone in `%s` in the last %d weeks", areaName, reportWeeks)
+	}
+
+	// The grid is a day per line and a character per hour, with the
+	// busier hours getting the "darker" characters
+	report := fmt.Sprintf("A typical week in `%s` (over the last %d weeks):\n", areaName, reportWeeks)
+	report += "```\n"
+	report += "     12a   6a    12p   6p\n"
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		report += day.String()[:3] + "  "
+		for hour := 0; hour < 24; hour++ {
+			shade := int(profile.Occupancy[day][hour] * float64(len(reportShades)-1))
+			if shade == 0 && profile.Occupancy[day][hour] > 0 {
+				// Anyone at all should show up
+				shade = 1
+			}
+			report += reportShades[shade]
+		}
+		report += "\n"
+	}
+	report += "```\n"
+
+	report += "Busiest: " + formatSlots(busiest) + "\n"
+	report += "Quietest: " + formatSlots(profile.Quietest(reportSlots))
+
+	return report
+}
+
+// formatSlots lists the hours with how busy they are, e.g.
+// "*Tue 7pm* (56%), *Sat 2pm* (40%)"
+func formatSlots(slots []history.Slot) string {
+	var formatted []string
+	for _, s := range slots {
+		formatted = append(formatted, fmt.Sprintf("*%s* (%d%%)", s, s.Percent()))
+	}
+	return strings.Join(formatted, ", ")
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pumpingstationone/shopmon/shared/message"
+	"github.com/slack-go/slack"
+)
+
+/*
+ * /shopmon works from any channel (once the app has been added to the
+ * workspace), and only the person who asked sees the answer, so it doesn't
+ * fill the channel up like !area does:
+ *
+ *	/shopmon area woodshop	when someone was last in the woodshop
+ *	/shopmon all		the same for every area
+ *	/shopmon open		which areas have someone in them, and which
+ *				doors are open, right now (who's open works too)
+ *	/shopmon history woodshop	what a typical week in the woodshop
+ *				looks like (the same as !report)
+ *
+ * The answers are Block Kit messages with an emoji for each area and a
+ * refresh button, which asks again and replaces the answer with the new one.
+ * Slack only sends slash commands and button clicks to apps using Socket
+ * Mode or the Events API (see connect.go), so none of this works with rtm.
+ */
+
+// The action ID of the refresh button; its value is the command to
+// run again
+const refreshAction = "shopmon_refresh"
+
+// The emoji for each area, depending on what's going on in it
+const (
+	emojiOccupied = ":large_green_circle:"
+	emojiDoorOpen = ":door:"
+	emojiEmpty    = ":white_circle:"
+	emojiUnknown  = ":grey_question:"
+)
+
+// slashHelp is what we say if we don't understand the command
+const slashHelp = "Hmm, try one of these:\n" +
+	"`/shopmon area <area>` to see when someone was last in an area\n" +
+	"`/shopmon all` to see every area\n" +
+	"`/shopmon open` to see who's in the space, and which doors are open, right now\n" +
+	"`/shopmon history <area>` to see what a typical week in an area looks like"
+
+// slashReply is the answer to /shopmon <text>, as a message that only
+// the person who asked can see
+func slashReply(text string) *slack.WebhookMessage {
+	text = strings.ToLower(strings.TrimSpace(text))
+	command, rest := text, ""
+	if i := strings.Index(text, " "); i >= 0 {
+		command, rest = text[:i], strings.TrimSpace(text[i+1:])
+	}
+
+	var blocks []slack.Block
+	switch command {
+	case "area":
+		area, reply := resolveArea(rest)
+		if len(area) == 0 {
+			return helpReply(reply)
+		}
+		blocks = areaBlocks([]string{area}, time.Now())
+	case "all":
+		blocks = areaBlocks(knownAreas(), time.Now())
+	case "open", "who's", "whos", "who’s":
+		blocks = openBlocks(time.Now())
+	case "history":
+		area, reply := resolveArea(rest)
+		if len(area) == 0 {
+			return helpReply(reply)
+		}
+		blocks = textBlocks(reportForAreaHistory(area))
+	default:
+		return helpReply(slashHelp)
+	}
+
+	// And when it was, with a button to ask again
+	blocks = append(blocks,
+		slack.NewContextBlock("", slack.NewTextBlockObject(slack.MarkdownType,
+			"As of "+time.Now().Format("3:04pm"), false, false)),
+		slack.NewActionBlock("", slack.NewButtonBlockElement(refreshAction, text,
+			slack.NewTextBlockObject(slack.PlainTextType, "Refresh", false, false))),
+	)
+
+	return &slack.WebhookMessage{
+		ResponseType: slack.ResponseTypeEphemeral,
+		// For notifications, and anything that can't show blocks
+		Text:   "/shopmon " + text,
+		Blocks: &slack.Blocks{BlockSet: blocks},
+	}
+}
+
+// helpReply is some help, which there's no point refreshing
+func helpReply(text string) *slack.WebhookMessage {
+	return &slack.WebhookMessage{
+		ResponseType: slack.ResponseTypeEphemeral,
+		Text:         text,
+	}
+}
+
+// refreshReply is the answer to someone pressing the refresh button,
+// which replaces the answer they already have
+func refreshReply(callback slack.InteractionCallback) *slack.WebhookMessage {
+	for _, action := range callback.ActionCallback.BlockActions {
+		if action.ActionID == refreshAction {
+			reply := slashReply(action.Value)
+			reply.ReplaceOriginal = true
+			return reply
+		}
+	}
+	return nil
+}
+
+// textBlocks is a single section of markdown
+func textBlocks(text string) []slack.Block {
+	return []slack.Block{
+		slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, text, false, false), nil, nil),
+	}
+}
+
+// areaLine is the emoji and what's going on in the area. The caller
+// must hold the mutex
+func areaLine(area string, now time.Time) string {
+	opening := message.IsOpening(sensors.AreaKind(area))
+	for _, a := range sensorsOn {
+		if a != area {
+			continue
+		}
+		if opening {
+			return fmt.Sprintf("%s The `%s` is *open* right now", emojiDoorOpen, area)
+		}
+		return fmt.Sprintf("%s There's someone in `%s` right now", emojiOccupied, area)
+	}
+
+	if seen, ok := sensorMap[area]; ok {
+		return emojiEmpty + " " + lastSeenLine(area, formatTime(now.Sub(seen)))
+	}
+	return emojiUnknown + " " + neverSeenLine(area)
+}
+
+// areaBlocks is a line for each of the areas, sorted by name
+func areaBlocks(areas []string, now time.Time) []slack.Block {
+	sort.Strings(areas)
+
+	lines := ""
+	mutex.Lock()
+	for _, area := range areas {
+		lines += areaLine(area, now) + "\n"
+	}
+	mutex.Unlock()
+
+	if len(lines) == 0 {
+		lines = "I don't know of any areas yet"
+	}
+	return textBlocks(strings.TrimSpace(lines))
+}
+
+// openBlocks is every area with someone in it, and every door that's
+// open, right now
+func openBlocks(now time.Time) []slack.Block {
+	occupied := make(map[string]bool)
+	mutex.Lock()
+	for _, area := range sensorsOn {
+		occupied[area] = true
+	}
+	mutex.Unlock()
+
+	var areas []string
+	for area := range occupied {
+		if !message.IsOpening(sensors.AreaKind(area)) {
+			areas = append(areas, area)
+		}
+	}
+	sort.Strings(areas)
+
+	lines := ""
+	for _, area := range areas {
+		lines += fmt.Sprintf("%s There's someone in `%s`\n", emojiOccupied, area)
+	}
+	if len(lines) == 0 {
+		lines = emojiEmpty + " There's no one in the space right now\n"
+	}
+
+	// The doors come from sensorstatus, which knows how long
+	// they've been open for
+	for _, name := range doorNames() {
+		doorMutex.Lock()
+		door, ok := doors[name]
+		doorMutex.Unlock()
+		if ok && door.Open() {
+			lines += fmt.Sprintf("%s The `%s` has been open for *%s*\n", emojiDoorOpen, name, formatTime(door.OpenFor(now)))
+		}
+	}
+
+	return textBlocks(strings.TrimSpace(lines))
+}
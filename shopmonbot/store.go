@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+ * The whole point of the bot is that we always know when someone was last
+ * in an area, but sensorMap only lives in memory, so after a restart we
+ * wouldn't know anything until the sensors fired again (and a quiet area
+ * could be "unknown" for days). So we save the map to a JSON file every so
+ * often, and when we're shutting down, and read it back in when we start.
+ *
+ * The file is written to a temporary file next to it and then renamed over
+ * the top, so a crash or power cut part way through writing it doesn't
+ * leave us with half a file.
+ */
+
+// Whether sensorMap has changed since we last saved it; this is
+// guarded by the same mutex as sensorMap
+var sensorMapChanged = false
+
+// loadAreas reads the saved map into sensorMap. A missing file
+// just means we haven't saved anything yet
+func loadAreas(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved map[string]time.Time
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("bad state file %s: %v", path, err)
+	}
+
+	mutex.Lock()
+	for area, tm := range saved {
+		// Anything we've heard about since we started is newer
+		if existing, ok := sensorMap[area]; !ok || tm.After(existing) {
+			sensorMap[area] = tm
+		}
+	}
+	mutex.Unlock()
+
+	fmt.Printf("Loaded %d areas from %s\n", len(saved), path)
+
+	return nil
+}
+
+// saveAreas writes sensorMap to the file if it has changed since
+// the last time we saved it
+func saveAreas(path string) error {
+	mutex.Lock()
+	if !sensorMapChanged {
+		mutex.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(sensorMap, "", "  ")
+	sensorMapChanged = false
+	mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomically(path, data); err != nil {
+		// We'll have to try again next time
+		mutex.Lock()
+		sensorMapChanged = true
+		mutex.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// writeFileAtomically writes the data to a temporary file in the
+// same directory and renames it to path once it's safely on disk
+func writeFileAtomically(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	// If anything goes wrong, don't leave the temporary file lying around
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// saveAreasPeriodically saves sensorMap every so often until the
+// context is cancelled
+func saveAreasPeriodically(ctx context.Context, path string, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := saveAreas(path); err != nil {
+				fmt.Println("Could not save areas:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pumpingstationone/shopmon/shared/registry"
+)
+
+/*
+ * JSON versions of what's on the map, for anything that wants to know who's
+ * in the space without having to pick apart the websocket messages (door
+ * displays, the wiki and so on). Everything comes from sensors.json and
+ * the state table in state.go, so it's only as up to date as the last
+ * message we got from sensorstatus, and we don't know when anything was
+ * last seen before the website was started.
+ */
+
+// SensorStatus is a sensor from sensors.json along with what we
+// currently know about it. LastSeen is left out if we haven't heard
+// from the sensor since we started
+type SensorStatus struct {
+	registry.Sensor
+	On       bool       `json:"on"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// AreaStatus is an area and whether anyone is in it, which is the
+// case if any of its sensors are on
+type AreaStatus struct {
+	Area      string         `json:"area"`
+	Occupied  bool           `json:"occupied"`
+	LastSeen  *time.Time     `json:"last_seen,omitempty"`
+	SensorsOn []string       `json:"sensors_on"`
+	Sensors   []SensorStatus `json:"sensors,omitempty"`
+}
+
+// writeJSON sends v back to the client as JSON
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// sensorStatuses merges sensors.json with the state table. Sensors
+// we've heard from that aren't in sensors.json are included too,
+// with whatever the messages said about them
+func sensorStatuses() []SensorStatus {
+	states := make(map[string]SensorState)
+	for _, s := range sensorStates.snapshot() {
+		states[s.Sensor] = s
+	}
+
+	var statuses []SensorStatus
+	for _, sensor := range sensors.Sensors() {
+		status := SensorStatus{Sensor: sensor}
+		if s, ok := states[sensor.Name]; ok {
+			status.On = s.On
+			lastSeen := s.LastSeen
+			status.LastSeen = &lastSeen
+			delete(states, sensor.Name)
+		}
+		statuses = append(statuses, status)
+	}
+
+	for _, s := range states {
+		lastSeen := s.LastSeen
+		statuses = append(statuses, SensorStatus{
+			Sensor:   registry.Sensor{Name: s.Sensor, Area: s.Area, Kind: s.Kind},
+			On:       s.On,
+			LastSeen: &lastSeen,
+		})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	return statuses
+}
+
+// areaStatuses groups the sensors into their areas, sorted by name
+func areaStatuses() []AreaStatus {
+	byArea := make(map[string]*AreaStatus)
+	var names []string
+
+	for _, s := range sensorStatuses() {
+		if len(s.Area) == 0 {
+			continue
+		}
+		area, ok := byArea[s.Area]
+		if !ok {
+			area = &AreaStatus{Area: s.Area, SensorsOn: []string{}}
+			byArea[s.Area] = area
+			names = append(names, s.Area)
+		}
+
+		area.Sensors = append(area.Sensors, s)
+		if s.On {
+			area.Occupied = true
+			area.SensorsOn = append(area.SensorsOn, s.Name)
+		}
+		if s.LastSeen != nil && (area.LastSeen == nil || s.LastSeen.After(*area.LastSeen)) {
+			area.LastSeen = s.LastSeen
+		}
+	}
+
+	sort.Strings(names)
+	areas := make([]AreaStatus, 0, len(names))
+	for _, name := range names {
+		areas = append(areas, *byArea[name])
+	}
+
+	return areas
+}
+
+// serveSensors returns every sensor in sensors.json, and every other
+// sensor we've heard from, along with whether it's on and when it was
+// last seen. The page uses this to make sure every sensor has a spot
+// on the map
+func serveSensors(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.URL)
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, sensorStatuses())
+}
+
+// serveAreas handles both /api/areas, which returns every area and
+// whether it's occupied, and /api/areas/<name>, which returns a single
+// area along with all of its sensors. The area name is matched without
+// worrying about case, so /api/areas/woodshop works
+func serveAreas(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.URL)
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// r.URL.Path has already been unescaped, so "CNC%20Lounge" is
+	// "CNC Lounge" by now
+	name := strings.TrimPrefix(r.URL.Path, "/api/areas")
+	name = strings.Trim(name, "/")
+
+	areas := areaStatuses()
+
+	if len(name) == 0 {
+		// The list doesn't need every sensor in every area
+		for i := range areas {
+			areas[i].Sensors = nil
+		}
+		writeJSON(w, areas)
+		return
+	}
+
+	for _, area := range areas {
+		if strings.EqualFold(area.Area, name) {
+			writeJSON(w, area)
+			return
+		}
+	}
+
+	http.Error(w, "No such area", http.StatusNotFound)
+}
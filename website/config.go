@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/pumpingstationone/shopmon/shared/mqttclient"
+)
+
+// Config is everything that can be set in config.ini, the
+// environment or on the command line (see the shared/config package)
+type Config struct {
+	MQTT    mqttclient.Options
+	Topics  TopicConfig
+	Web     WebConfig
+	Sensors SensorConfig
+	History HistoryConfig
+}
+
+// TopicConfig is the MQTT topics we use
+type TopicConfig struct {
+	// The topic to listen on. This is specific to how your
+	// topics are set up on the server. You can listen to more
+	// than one at a time in a hierarchy with the octothorp ("#")
+	// character (e.g. "/occupancy/#" ). This is the JSON feed from
+	// sensorstatus, but the old "webshopmontopic" works too
+	Status string `help:"topic to get sensor status from"`
+}
+
+// WebConfig is for the webserver itself
+type WebConfig struct {
+	Addr string `flag:"addr" help:"http service address"`
+}
+
+// SensorConfig is where we find out about the sensors
+type SensorConfig struct {
+	File string `help:"the sensors.json file from the sensors program"`
+}
+
+// HistoryConfig is where we keep the history of every sensor
+// for /api/history (see history.go)
+type HistoryConfig struct {
+	File string `help:"the SQLite database to record history in, or nothing to not keep any"`
+}
+
+// defaultConfig is what we use if nothing else is given
+func defaultConfig() Config {
+	return Config{
+		MQTT: mqttclient.Options{
+			Broker: "tcp://10.10.1.224:1883",
+			// The clientID must be a unique name for listening on the
+			// topics, otherwise you may get disconnect errors
+			ClientID: "shopmon2",
+		},
+		Topics: TopicConfig{
+			Status: "shopmon/status",
+		},
+		Web: WebConfig{
+			Addr: ":8080",
+		},
+		Sensors: SensorConfig{
+			File: "../sensors/sensors.json",
+		},
+		History: HistoryConfig{
+			File: "history.db",
+		},
+	}
+}
+
+// Validate checks the parts of the config that are ours
+func (c *Config) Validate() error {
+	if len(c.Topics.Status) == 0 {
+		return errors.New("no status topic given")
+	}
+	if len(c.Web.Addr) == 0 {
+		return errors.New("no http service address given")
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pumpingstationone/shopmon/shared/history"
+)
+
+/*
+ * Everything we get from sensorstatus is also written down in a SQLite
+ * database (see the history package in shared), so that we can answer
+ * questions like "how busy is the woodshop on Tuesday nights" instead of
+ * only knowing what's going on right now.
+ */
+
+// The history database, or nil if we've been told not to keep one
+var historyDB *history.DB
+
+// How much history we return if we're not told otherwise
+const (
+	defaultHistoryRange  = 24 * time.Hour
+	defaultHistoryBucket = time.Hour
+)
+
+// HistoryResponse is what /api/history returns
+type HistoryResponse struct {
+	Area    string           `json:"area,omitempty"`
+	Sensor  string           `json:"sensor,omitempty"`
+	From    time.Time        `json:"from"`
+	To      time.Time        `json:"to"`
+	Bucket  string           `json:"bucket"`
+	Buckets []history.Bucket `json:"buckets"`
+}
+
+// openHistory opens the history database if we have one
+func openHistory() {
+	if len(cfg.History.File) == 0 {
+		return
+	}
+
+	var err error
+	historyDB, err = history.Open(cfg.History.File)
+	if err != nil {
+		// The rest of the website still works without it
+		log.Println("Could not open history:", err)
+	}
+}
+
+// serveHistory returns how long an area or sensor (or everything, if
+// neither is given) was occupied and how many times its sensors were
+// triggered in each bucket of time, e.g.
+//
+//	/api/history?area=Woodshop&from=2021-03-02&to=2021-03-03&bucket=1h
+//
+// from and to can be dates, RFC 3339 times or unix timestamps, and
+// default to the last day. bucket defaults to an hour.
+func serveHistory(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.URL)
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if historyDB == nil {
+		http.Error(w, "No history is being kept", http.StatusNotFound)
+		return
+	}
+
+	params := r.URL.Query()
+
+	q := history.Query{
+		Area:   findArea(params.Get("area")),
+		Sensor: params.Get("sensor"),
+		To:     time.Now(),
+		Bucket: defaultHistoryBucket,
+	}
+
+	var err error
+	if to := params.Get("to"); len(to) > 0 {
+		if q.To, err = parseTime(to); err != nil {
+			http.Error(w, "Bad to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	q.From = q.To.Add(-defaultHistoryRange)
+	if from := params.Get("from"); len(from) > 0 {
+		if q.From, err = parseTime(from); err != nil {
+			http.Error(w, "Bad from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if bucket := params.Get("bucket"); len(bucket) > 0 {
+		if q.Bucket, err = time.ParseDuration(bucket); err != nil {
+			http.Error(w, "Bad bucket: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := q.Check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	buckets, err := historyDB.Buckets(q)
+	if err != nil {
+		log.Println("Could not look up history:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, HistoryResponse{
+		Area:    q.Area,
+		Sensor:  q.Sensor,
+		From:    q.From,
+		To:      q.To,
+		Bucket:  q.Bucket.String(),
+		Buckets: buckets,
+	})
+}
+
+// The windows the heatmap can cover
+var heatmapWindows = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+	"week": 7 * 24 * time.Hour,
+}
+
+// HeatmapSensor is how much a sensor was used during the heatmap's
+// window. Utilisation is the fraction of the window that it was on,
+// and Heat is how busy it was compared to the busiest sensor, from
+// 0 (not at all) to 1 (the busiest one), which is what the page
+// colours it by
+type HeatmapSensor struct {
+	history.Total
+	Utilisation float64 `json:"utilisation"`
+	Heat        float64 `json:"heat"`
+}
+
+// HeatmapResponse is what /api/heatmap returns
+type HeatmapResponse struct {
+	Window  string          `json:"window"`
+	From    time.Time       `json:"from"`
+	To      time.Time       `json:"to"`
+	Sensors []HeatmapSensor `json:"sensors"`
+}
+
+// serveHeatmap returns how much every sensor in sensors.json was used
+// over the last hour, day or week (?window=hour, day or week; a day if
+// it isn't given), for the heatmap on the page. It's worked out from
+// the status messages we record ourselves (see dispatchStatus())
+func serveHeatmap(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.URL)
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if historyDB == nil {
+		http.Error(w, "No history is being kept", http.StatusNotFound)
+		return
+	}
+
+	window := r.URL.Query().Get("window")
+	if len(window) == 0 {
+		window = "day"
+	}
+	length, ok := heatmapWindows[window]
+	if !ok {
+		http.Error(w, "window has to be hour, day or week", http.StatusBadRequest)
+		return
+	}
+
+	to := time.Now()
+	from := to.Add(-length)
+	totals, err := historyDB.Totals(from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Every sensor gets a spot on the heatmap, even if it wasn't used
+	used := make(map[string]history.Total)
+	for _, t := range totals {
+		used[t.Sensor] = t
+	}
+	var heatmap []HeatmapSensor
+	var busiest int64
+	for _, sensor := range sensors.Sensors() {
+		t, ok := used[sensor.Name]
+		if !ok {
+			t = history.Total{Sensor: sensor.Name, Area: sensor.Area}
+		}
+		if t.OccupiedSeconds > busiest {
+			busiest = t.OccupiedSeconds
+		}
+		heatmap = append(heatmap, HeatmapSensor{
+			Total:       t,
+			Utilisation: float64(t.OccupiedSeconds) / length.Seconds(),
+		})
+	}
+	if busiest > 0 {
+		for i := range heatmap {
+			heatmap[i].Heat = float64(heatmap[i].OccupiedSeconds) / float64(busiest)
+		}
+	}
+
+	writeJSON(w, HeatmapResponse{
+		Window:  window,
+		From:    from,
+		To:      to,
+		Sensors: heatmap,
+	})
+}
+
+// findArea turns the area someone asked for into the area's name in
+// sensors.json, so that "woodshop" finds the Woodshop's history
+func findArea(name string) string {
+	for _, area := range sensors.Areas() {
+		if strings.EqualFold(area, name) {
+			return area
+		}
+	}
+	return name
+}
+
+// parseTime understands a date (in our time zone), an RFC 3339 time
+// or a unix timestamp
+func parseTime(s string) (time.Time, error) {
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date, time or timestamp", s)
+}
@@ -1,19 +1,24 @@
 package main
 
 import (
-	"flag"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pumpingstationone/shopmon/shared/config"
+	"github.com/pumpingstationone/shopmon/shared/message"
+	"github.com/pumpingstationone/shopmon/shared/registry"
 )
 
 // StatusMessage is a struct that is passed from the
 // MQTT goroutine (see listenOnTopic() in mqtt.go)
-// to the readPump() function in this file. It is
+// to the dispatchStatus() function in this file. It is
 // a struct so that more fields can be added later
 // if necessary
 type StatusMessage struct {
@@ -23,7 +28,14 @@ type StatusMessage struct {
 // Our channel that accepts StatusMessages
 var statusChannel chan StatusMessage
 
-var addr = flag.String("addr", ":8080", "http service address")
+// The latest state of every sensor, for newly connected clients
+var sensorStates = newStateTable()
+
+// Every sensor we know about, from sensors.json
+var sensors *registry.Registry
+
+// Our settings (see config.go)
+var cfg = defaultConfig()
 
 const (
 	// Time allowed to write a message to the peer.
@@ -39,11 +51,6 @@ const (
 	maxMessageSize = 512
 )
 
-var (
-	newline = []byte{'\n'}
-	space   = []byte{' '}
-)
-
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -60,6 +67,51 @@ type Client struct {
 	send chan []byte
 }
 
+// dispatchStatus is the single consumer of statusChannel. Every status
+// message that comes off the MQTT topic is recorded in the state table,
+// turned into a websocket message (see protocol.go) and handed to the hub,
+// which fans it out to every connected client. Previously each
+// client's readPump() pulled from statusChannel itself, which meant a
+// given message only went to whichever client happened to win the receive.
+func dispatchStatus(hub *Hub) {
+	for {
+		statusMsg := <-statusChannel
+
+		// This understands both the JSON and the old
+		// comma-separated form of the message
+		event, err := message.Parse([]byte(statusMsg.spaceStatus))
+		if err != nil {
+			log.Printf("Ignoring message: %v\n", err)
+			continue
+		}
+
+		// Keep track of it for clients that connect later
+		sensorStates.update(event)
+
+		// And write it down for /api/history
+		if historyDB != nil {
+			if err := historyDB.RecordStatus(event, time.Now()); err != nil {
+				log.Println(err)
+			}
+		}
+
+		msgToSend, err := encodeStatus(event)
+		if err != nil {
+			log.Printf("Could not build message for %s: %v\n", event.Sensor, err)
+			continue
+		}
+
+		// And hand it to the hub to send to every client
+		log.Printf("Sending %s\n", msgToSend)
+		hub.broadcast <- msgToSend
+	}
+}
+
+// readPump pumps messages from the websocket connection to the hub.
+//
+// The page doesn't send us anything we act on, but we still have to read
+// from the connection so that pongs are processed and so that we notice
+// when the client goes away and can unregister it.
 func (c *Client) readPump() {
 	defer func() {
 		c.hub.unregister <- c
@@ -71,49 +123,13 @@ func (c *Client) readPump() {
 	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 
 	for {
-		statusMsg := <-statusChannel
-
-		// We get a message that is in the form of:
-		// 		timestamp,sensor/topic name,1 or 0
-		// where the third field is a 1 or 0 to indicate that
-		// the sensor on the detected someone.
-		//
-		// What we are going to do is send back to the client
-		// the message with an html snippet appended to it, either
-		// the image, if we want to show that someone is there, or
-		// just a <p/> which, of course, won't show anything.
-		//
-		// Note that the CSS on the webpage sets up the size of the
-		// image via the "pulse" class, and it will use the topic
-		// name for matching against the css id.
-		//
-		// December 10, 2020; if statusPart[1] contains the phrase
-		// "door", then we use a different animated gif, as those
-		// are door sensors and we want to show a different image
-		// to indicate the door is open
-		statusParts := strings.Split(statusMsg.spaceStatus, ",")
-		statusHTML := "<p/>"
-		if statusParts[2] == "1" {
-			// Are we a door, or a PIR sensor?
-			if strings.Contains(statusParts[1], "Door") {
-				// Yes, this is a door
-				statusHTML = "<img class=\"pulse\" src=\"/img/dooropen.gif\"/>"
-			} else {
-				// Not a door, a regular area sensor
-				statusHTML = "<img class=\"pulse\" src=\"/img/activity.gif\"/>"
+		_, _, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("error: %v", err)
 			}
+			break
 		}
-
-		// And piece it all together
-		msgToSend := fmt.Sprintf("%s|%s", statusMsg.spaceStatus, statusHTML)
-
-		// And send t back to the client over the socket
-		log.Printf("Sending %s\n", msgToSend)
-		c.hub.broadcast <- []byte(msgToSend)
-
-		// To prevent overwhelming the client and to give the status
-		// a couple of seconds to actually show
-		time.Sleep(2 * time.Second)
 	}
 }
 
@@ -138,20 +154,10 @@ func (c *Client) writePump() {
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			// Add queued chat messages to the current websocket message.
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-c.send)
-			}
-
-			if err := w.Close(); err != nil {
+			// Each message is a JSON object, so they each get a
+			// websocket message of their own rather than being
+			// stuck together
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -173,12 +179,32 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
 	client.hub.register <- client
 
+	// Send the new client everything we currently know so the map is
+	// right from the start. The writePump isn't running yet, so we're
+	// the only writer on the connection, and anything the hub broadcasts
+	// in the meantime just waits in client.send
+	if err := sendSnapshot(conn); err != nil {
+		log.Println(err)
+	}
+
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
 	go client.writePump()
 	go client.readPump()
 }
 
+// sendSnapshot writes the current state of every sensor to the
+// connection as a single snapshot message (see protocol.go)
+func sendSnapshot(conn *websocket.Conn) error {
+	snapshot, err := encodeSnapshot(sensorStates.snapshot())
+	if err != nil {
+		return err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteMessage(websocket.TextMessage, snapshot)
+}
+
 // Our standard webserver handler
 func serveHome(w http.ResponseWriter, r *http.Request) {
 	log.Println(r.URL)
@@ -195,23 +221,52 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	// Read our settings first, as everything depends on them
+	if err := config.Load("website", &cfg, os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	// Everything runs until we get told to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Find out what sensors we have, and keep an eye on the file
+	// for any new ones
+	sensors = registry.New(cfg.Sensors.File)
+	if err := sensors.Reload(); err != nil {
+		log.Println("Could not load sensors:", err)
+	}
+	go sensors.Watch(ctx)
+
+	// And where we keep the history of every sensor
+	openHistory()
+	if historyDB != nil {
+		defer historyDB.Close()
+	}
 
 	// Create a buffered channel; 200 is arbitrary but figured based
 	// on the number of sensors + the time it takes to fully come up to
 	// speed
 	statusChannel = make(chan StatusMessage, 200)
 
-	// Set us up to listen to the topics on the MQTT server...
-	go listenOnTopic()
+	// Set us up to listen to the topics on the MQTT server. We don't
+	// wait for it, as the page is still worth serving while we wait
+	// for the MQTT server to show up
+	go func() {
+		if err := listenOnTopic(ctx); err != nil && ctx.Err() == nil {
+			log.Println("Could not listen on MQTT topic:", err)
+		}
+	}()
 
 	// From here on out we're setting up the websockets layer
 	// and spinning up the webserver
-	flag.Parse()
-
 	// And set up our hub and run it
 	hub := newHub()
 	go hub.run()
 
+	// The one and only reader of statusChannel; it feeds the hub
+	go dispatchStatus(hub)
+
 	// Serve the images from the "img" directory
 	fileServer := http.FileServer(http.Dir("./img/"))
 	http.Handle("/img/", http.StripPrefix("/img", fileServer))
@@ -221,12 +276,27 @@ func main() {
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		serveWs(hub, w, r)
 	})
+	http.HandleFunc("/api/sensors", serveSensors)
+	http.HandleFunc("/api/areas", serveAreas)
+	http.HandleFunc("/api/areas/", serveAreas)
+	http.HandleFunc("/api/history", serveHistory)
+	http.HandleFunc("/api/heatmap", serveHeatmap)
+	http.HandleFunc("/reports", serveReports)
+
+	// Shut the webserver down nicely when we're told to stop
+	server := &http.Server{Addr: cfg.Web.Addr}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), writeWait)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
 
 	// And here we go!
-	err := http.ListenAndServe(*addr, nil)
-	if err != nil {
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatal("ListenAndServe: ", err)
 	}
 
-	fmt.Println("hello world")
+	fmt.Println("Goodbye")
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/pumpingstationone/shopmon/shared/message"
+)
+
+/*
+ * What we send down the websocket. Every websocket message is a single JSON
+ * object with a "type" saying what it is:
+ *
+ *	{"type":"status","sensor":"Woodshop-1","area":"Woodshop","state":1,"ts":1597446363,"kind":"pir"}
+ *
+ * when a sensor's state comes in from sensorstatus, and
+ *
+ *	{"type":"snapshot","sensors":[{"type":"status",...},...]}
+ *
+ * with every sensor we know about, right after a client connects. We used to
+ * send the old status line with a bit of html stuck on the end, which meant
+ * the page had to pick the line apart to find the sensor, and anything else
+ * that wanted to use /ws had to do the same. Now how things look is entirely
+ * up to the page.
+ */
+
+// The types of websocket message
+const (
+	wsTypeStatus   = "status"
+	wsTypeSnapshot = "snapshot"
+)
+
+// WSStatus is the state of a single sensor
+type WSStatus struct {
+	Type   string `json:"type"`
+	Sensor string `json:"sensor"`
+	Area   string `json:"area"`
+	State  int    `json:"state"`
+	TS     int64  `json:"ts"`
+	// The kind of sensor (e.g. "pir" or "door"; see the message
+	// package), so the page knows how to show it
+	Kind string `json:"kind"`
+}
+
+// WSSnapshot is the state of every sensor
+type WSSnapshot struct {
+	Type    string     `json:"type"`
+	Sensors []WSStatus `json:"sensors"`
+}
+
+// newWSStatus builds the websocket message for the event
+func newWSStatus(e message.Event) WSStatus {
+	// sensorstatus tells us the kind, but sensors.json knows best,
+	// and if neither of them know it's a PIR sensor
+	kind := e.Kind
+	if s, ok := sensors.Lookup(e.Sensor); ok {
+		kind = s.Kind
+	}
+	if len(kind) == 0 {
+		kind = message.KindPIR
+	}
+
+	return WSStatus{
+		Type:   wsTypeStatus,
+		Sensor: e.Sensor,
+		Area:   e.Area,
+		State:  e.State,
+		TS:     e.Timestamp,
+		Kind:   kind,
+	}
+}
+
+// encodeStatus turns the event into the JSON we send down the websocket
+func encodeStatus(e message.Event) ([]byte, error) {
+	return json.Marshal(newWSStatus(e))
+}
+
+// encodeSnapshot turns the whole state table into the JSON we send
+// to new clients
+func encodeSnapshot(states []SensorState) ([]byte, error) {
+	snapshot := WSSnapshot{
+		Type:    wsTypeSnapshot,
+		Sensors: make([]WSStatus, 0, len(states)),
+	}
+	for _, s := range states {
+		snapshot.Sensors = append(snapshot.Sensors, newWSStatus(s.event()))
+	}
+	return json.Marshal(snapshot)
+}
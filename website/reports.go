@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pumpingstationone/shopmon/shared/history"
+)
+
+/*
+ * The /reports page shows what a typical week looks like for an area, as a
+ * grid of days and hours shaded by how often someone is usually there, along
+ * with the busiest and quietest hours. It's all worked out from the history
+ * we keep (see history.go), so it's only as good as the history we have.
+ */
+
+// How many weeks of history the report covers if we're not told
+// otherwise, and the most it will
+const (
+	defaultReportWeeks = 4
+	maxReportWeeks     = 52
+)
+
+// How many of the busiest and quietest hours we list
+const reportSlots = 5
+
+// ReportPage is everything reports.html needs
+type ReportPage struct {
+	Areas    []string
+	Area     string
+	Weeks    int
+	Hours    []string
+	Rows     []ReportRow
+	Busiest  []history.Slot
+	Quietest []history.Slot
+	Error    string
+}
+
+// ReportRow is a day of the week in the grid
+type ReportRow struct {
+	Day   string
+	Cells []ReportCell
+}
+
+// ReportCell is an hour of a day in the grid
+type ReportCell struct {
+	Percent int
+	Colour  template.CSS
+	Title   string
+}
+
+// serveReports renders the report for the area in ?area= (or just
+// the list of areas if there isn't one), over the last ?weeks=
+func serveReports(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.URL)
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Read the template every time so it can be changed without
+	// restarting, same as shop.html
+	tmpl, err := template.ParseFiles("reports.html")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not load the report page", http.StatusInternalServerError)
+		return
+	}
+
+	page := ReportPage{
+		Areas: sensors.Areas(),
+		Area:  findArea(r.URL.Query().Get("area")),
+		Weeks: defaultReportWeeks,
+	}
+	if weeks := r.URL.Query().Get("weeks"); len(weeks) > 0 {
+		page.Weeks, err = strconv.Atoi(weeks)
+		if err != nil || page.Weeks < 1 || page.Weeks > maxReportWeeks {
+			http.Error(w, fmt.Sprintf("weeks has to be between 1 and %d", maxReportWeeks), http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch {
+	case len(page.Area) == 0:
+		// Just the list of areas to pick from
+	case historyDB == nil:
+		page.Error = "No history is being kept, so there's nothing to report."
+	default:
+		profile, err := historyDB.WeeklyProfile(page.Area, page.Weeks, time.Local)
+		if err != nil {
+			log.Println(err)
+			page.Error = "Could not work out the report: " + err.Error()
+			break
+		}
+		page.fillIn(profile)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(w, page); err != nil {
+		log.Println(err)
+	}
+}
+
+// fillIn builds the grid and the lists of hours from the profile
+func (page *ReportPage) fillIn(profile *history.Profile) {
+	for hour := 0; hour < 24; hour++ {
+		page.Hours = append(page.Hours, hourLabel(hour))
+	}
+
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		row := ReportRow{Day: day.String()[:3]}
+		for hour := 0; hour < 24; hour++ {
+			slot := history.Slot{Day: day, Hour: hour, Occupancy: profile.Occupancy[day][hour]}
+			row.Cells = append(row.Cells, ReportCell{
+				Percent: slot.Percent(),
+				// The busier it is, the darker the cell
+				Colour: template.CSS(fmt.Sprintf("rgba(200, 40, 40, %.2f)", slot.Occupancy)),
+				Title: fmt.Sprintf("%s: occupied %d%% of the time, %.1f activations",
+					slot, slot.Percent(), profile.Activations[day][hour]),
+			})
+		}
+		page.Rows = append(page.Rows, row)
+	}
+
+	page.Busiest = profile.Busiest(reportSlots)
+	page.Quietest = profile.Quietest(reportSlots)
+}
+
+// hourLabel is the hour the way it goes across the top of the grid
+func hourLabel(hour int) string {
+	switch {
+	case hour == 0:
+		return "12a"
+	case hour < 12:
+		return fmt.Sprintf("%da", hour)
+	case hour == 12:
+		return "12p"
+	default:
+		return fmt.Sprintf("%dp", hour-12)
+	}
+}
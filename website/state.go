@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pumpingstationone/shopmon/shared/message"
+)
+
+// SensorState is what we know about a single sensor, built up
+// from the status messages we get from sensorstatus
+type SensorState struct {
+	Sensor   string
+	Area     string
+	Kind     string
+	LastSeen time.Time
+	On       bool
+}
+
+// event puts the state back into the same form that we get it
+// from the topic so that new clients get exactly what they would
+// have gotten had they been connected when the message came in
+func (s SensorState) event() message.Event {
+	state := message.StateOff
+	if s.On {
+		state = message.StateOn
+	}
+	return message.Event{
+		Version:   message.Version,
+		Timestamp: s.LastSeen.Unix(),
+		Sensor:    s.Sensor,
+		Area:      s.Area,
+		Kind:      s.Kind,
+		State:     state,
+		Source:    message.SourceSensorStatus,
+	}
+}
+
+// StateTable keeps the latest state of every sensor we've heard
+// about so that when a browser connects we can send it the whole
+// picture right away instead of making it wait for the next event
+type StateTable struct {
+	mutex   sync.Mutex
+	sensors map[string]SensorState
+}
+
+func newStateTable() *StateTable {
+	return &StateTable{
+		sensors: make(map[string]SensorState),
+	}
+}
+
+// update records the latest event for a sensor in the table
+func (t *StateTable) update(e message.Event) {
+	t.mutex.Lock()
+	t.sensors[e.Sensor] = SensorState{
+		Sensor:   e.Sensor,
+		Area:     e.Area,
+		Kind:     e.Kind,
+		LastSeen: e.Time(),
+		On:       e.On(),
+	}
+	t.mutex.Unlock()
+}
+
+// snapshot returns a copy of the current state of every sensor,
+// sorted by sensor name so the output is stable
+func (t *StateTable) snapshot() []SensorState {
+	t.mutex.Lock()
+	states := make([]SensorState, 0, len(t.sensors))
+	for _, s := range t.sensors {
+		states = append(states, s)
+	}
+	t.mutex.Unlock()
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Sensor < states[j].Sensor
+	})
+
+	return states
+}